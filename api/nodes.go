@@ -0,0 +1,387 @@
+package api
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Nodes is used to query node-related API endpoints
+type Nodes struct {
+	client *Client
+}
+
+// Nodes returns a handle on the node endpoints.
+func (c *Client) Nodes() *Nodes {
+	return &Nodes{client: c}
+}
+
+// List is used to list out all of the nodes
+func (n *Nodes) List(q *QueryOptions) ([]*NodeListStub, *QueryMeta, error) {
+	var resp []*NodeListStub
+	qm, err := n.client.query("/v1/nodes", &resp, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(NodeIndexSort(resp))
+	return resp, qm, nil
+}
+
+// PrefixList is used to list out nodes matching an ID prefix. The prefix is
+// lower-cased before being sent, so a prefix pasted from logs or a dashboard
+// in mixed case still matches the (also lower-cased) server-side index.
+func (n *Nodes) PrefixList(prefix string) ([]*NodeListStub, *QueryMeta, error) {
+	return n.List(&QueryOptions{Prefix: strings.ToLower(prefix)})
+}
+
+// Info is used to query a specific node by its ID. The ID is matched
+// case-insensitively on the server, so callers may pass an ID copied
+// through a terminal or dashboard that altered its casing.
+func (n *Nodes) Info(nodeID string, q *QueryOptions) (*Node, *QueryMeta, error) {
+	var resp Node
+	qm, err := n.client.query("/v1/node/"+strings.ToLower(nodeID), &resp, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resp, qm, nil
+}
+
+// NodeUpdateDrainRequest is used to update the drain for a node.
+type NodeUpdateDrainRequest struct {
+	// NodeID is the node to update the drain specification for.
+	NodeID string
+
+	// DrainSpec is the drain specification to set for the node. A nil
+	// DrainSpec disables draining.
+	DrainSpec *DrainSpec
+
+	// MarkEligible marks the node as eligible for scheduling if removing
+	// the drain strategy.
+	MarkEligible bool
+}
+
+// NodeDrainUpdateResponse is used to respond to a node drain update.
+type NodeDrainUpdateResponse struct {
+	NodeModifyIndex uint64
+	EvalIDs         []string
+	EvalCreateIndex uint64
+	WriteMeta
+}
+
+// UpdateDrain is used to update the drain strategy for a given node. If
+// markEligible is true and the drain is being removed, the node is marked
+// as having its scheduling eligibility re-enabled.
+func (n *Nodes) UpdateDrain(nodeID string, spec *DrainSpec, markEligible bool, q *WriteOptions) (*NodeDrainUpdateResponse, error) {
+	req := &NodeUpdateDrainRequest{
+		NodeID:       nodeID,
+		DrainSpec:    spec,
+		MarkEligible: markEligible,
+	}
+
+	var resp NodeDrainUpdateResponse
+	wm, err := n.client.write("/v1/node/"+nodeID+"/drain", req, &resp, q)
+	if err != nil {
+		return nil, err
+	}
+	resp.WriteMeta = *wm
+	return &resp, nil
+}
+
+// NodeUpdateEligibilityRequest is used to update the scheduling eligibility
+// for a node.
+type NodeUpdateEligibilityRequest struct {
+	NodeID      string
+	Eligibility string
+}
+
+// NodeEligibilityUpdateResponse is used to respond to a node eligibility
+// update.
+type NodeEligibilityUpdateResponse struct {
+	NodeModifyIndex uint64
+	EvalIDs         []string
+	EvalCreateIndex uint64
+	WriteMeta
+}
+
+// ToggleEligibility is used to update the scheduling eligibility of the node.
+func (n *Nodes) ToggleEligibility(nodeID string, eligible bool, q *WriteOptions) (*NodeEligibilityUpdateResponse, error) {
+	elig := NodeSchedulingEligible
+	if !eligible {
+		elig = NodeSchedulingIneligible
+	}
+
+	req := &NodeUpdateEligibilityRequest{
+		NodeID:      nodeID,
+		Eligibility: elig,
+	}
+
+	var resp NodeEligibilityUpdateResponse
+	wm, err := n.client.write("/v1/node/"+nodeID+"/eligibility", req, &resp, q)
+	if err != nil {
+		return nil, err
+	}
+	resp.WriteMeta = *wm
+	return &resp, nil
+}
+
+// NodeSelector describes a set of nodes for a bulk operation to act on. The
+// server resolves the selector against a single state store snapshot, so
+// the set of affected nodes is consistent even if nodes register or
+// deregister concurrently. A zero-value NodeSelector matches every node.
+type NodeSelector struct {
+	// Datacenters, if non-empty, restricts the selector to nodes in one
+	// of the listed datacenters. Matched case-insensitively.
+	Datacenters []string
+
+	// NodeClass, if set, restricts the selector to nodes with this exact
+	// node class.
+	NodeClass string
+
+	// NameGlob, if set, restricts the selector to nodes whose Name
+	// matches the glob (e.g. "web-*").
+	NameGlob string
+
+	// Meta, if non-empty, restricts the selector to nodes whose Meta
+	// contains every listed key/value pair.
+	Meta map[string]string
+}
+
+// BulkNodeUpdateResult is the outcome of a bulk operation for a single node.
+type BulkNodeUpdateResult struct {
+	NodeID string
+
+	// Skipped is true when the operation was a no-op for the node: for an
+	// eligibility toggle, the node was already at the requested
+	// eligibility; for a drain without Force, the node was already
+	// draining with a deadline at least as long as the requested one.
+	Skipped bool
+
+	// Error is the failure reason, if this node could not be updated.
+	Error string
+}
+
+// BulkNodeUpdateResponse is the response for a bulk drain or eligibility
+// operation, reporting the outcome of every node the selector resolved to.
+type BulkNodeUpdateResponse struct {
+	Results []*BulkNodeUpdateResult
+	WriteMeta
+}
+
+// NodeBulkUpdateDrainRequest is used to update the drain for every node
+// matched by Selector.
+type NodeBulkUpdateDrainRequest struct {
+	Selector NodeSelector
+
+	// DrainSpec is the drain specification to apply. A nil DrainSpec
+	// disables draining.
+	DrainSpec *DrainSpec
+
+	// MarkEligible marks matched nodes as eligible for scheduling if
+	// removing the drain strategy.
+	MarkEligible bool
+
+	// Force overwrites an existing per-node drain strategy even if its
+	// deadline is longer than the one being requested. Without Force, a
+	// node already draining with a longer deadline is left alone and
+	// reported as Skipped.
+	Force bool
+}
+
+// BulkUpdateDrain is used to update the drain strategy for every node
+// matching selector in a single server-side operation. Without force, a
+// node already draining with a deadline at least as long as the requested
+// one is reported as Skipped rather than reprocessed, so retrying the same
+// drain skips the nodes it already updated. With force, or with a nil spec,
+// no node is skipped and every matched node is updated again.
+func (n *Nodes) BulkUpdateDrain(selector NodeSelector, spec *DrainSpec, markEligible, force bool, q *WriteOptions) (*BulkNodeUpdateResponse, error) {
+	req := &NodeBulkUpdateDrainRequest{
+		Selector:     selector,
+		DrainSpec:    spec,
+		MarkEligible: markEligible,
+		Force:        force,
+	}
+
+	var resp BulkNodeUpdateResponse
+	wm, err := n.client.write("/v1/nodes/drain", req, &resp, q)
+	if err != nil {
+		return nil, err
+	}
+	resp.WriteMeta = *wm
+	return &resp, nil
+}
+
+// NodeBulkUpdateEligibilityRequest is used to update the scheduling
+// eligibility for every node matched by Selector.
+type NodeBulkUpdateEligibilityRequest struct {
+	Selector    NodeSelector
+	Eligibility string
+}
+
+// BulkToggleEligibility is used to update the scheduling eligibility of
+// every node matching selector in a single server-side operation. Nodes
+// already at the requested eligibility are reported as Skipped.
+func (n *Nodes) BulkToggleEligibility(selector NodeSelector, eligible bool, q *WriteOptions) (*BulkNodeUpdateResponse, error) {
+	elig := NodeSchedulingEligible
+	if !eligible {
+		elig = NodeSchedulingIneligible
+	}
+
+	req := &NodeBulkUpdateEligibilityRequest{
+		Selector:    selector,
+		Eligibility: elig,
+	}
+
+	var resp BulkNodeUpdateResponse
+	wm, err := n.client.write("/v1/nodes/eligibility", req, &resp, q)
+	if err != nil {
+		return nil, err
+	}
+	resp.WriteMeta = *wm
+	return &resp, nil
+}
+
+// Allocations is used to return the allocations associated with a node.
+func (n *Nodes) Allocations(nodeID string, q *QueryOptions) ([]*Allocation, *QueryMeta, error) {
+	var resp []*Allocation
+	qm, err := n.client.query("/v1/node/"+nodeID+"/allocations", &resp, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(AllocIndexSort(resp))
+	return resp, qm, nil
+}
+
+// ForceEvaluate is used to force-evaluate an existing node.
+func (n *Nodes) ForceEvaluate(nodeID string, q *WriteOptions) (string, *WriteMeta, error) {
+	var resp nodeEvalResponse
+	wm, err := n.client.write("/v1/node/"+nodeID+"/evaluate", nil, &resp, q)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.EvalID, wm, nil
+}
+
+type nodeEvalResponse struct {
+	EvalID string
+}
+
+// GC is used to garbage collect a client's terminal allocations.
+func (n *Nodes) GC(nodeID string, q *QueryOptions) error {
+	var resp struct{}
+	_, err := n.client.query("/v1/node/"+nodeID+"/gc", &resp, q)
+	return err
+}
+
+// GcAlloc is used to garbage collect a single allocation on a client.
+func (n *Nodes) GcAlloc(allocID string, q *QueryOptions) error {
+	var resp struct{}
+	_, err := n.client.query("/v1/client/allocation/"+allocID+"/gc", &resp, q)
+	return err
+}
+
+// DrainSpec describes a Node's drain behavior.
+type DrainSpec struct {
+	// Deadline is the duration after which the remaining allocations on a
+	// draining node are force-stopped.
+	Deadline time.Duration
+
+	// IgnoreSystemJobs allows system jobs to remain on the node rather
+	// than being drained immediately.
+	IgnoreSystemJobs bool
+}
+
+// DrainStrategy describes the strategy and state of a node's drain.
+type DrainStrategy struct {
+	*DrainSpec
+
+	// ForceDeadline is the deadline time for the drain after which it is
+	// forced.
+	ForceDeadline time.Time
+
+	// StartedAt is the time the drain process started.
+	StartedAt time.Time
+}
+
+const (
+	NodeSchedulingEligible   = "eligible"
+	NodeSchedulingIneligible = "ineligible"
+)
+
+// Node is used to deserialize a node entry.
+type Node struct {
+	ID                    string
+	Datacenter            string
+	Name                  string
+	HTTPAddr              string
+	TLSEnabled            bool
+	Attributes            map[string]string
+	Resources             *Resources
+	Reserved              *Resources
+	NodeResources         *NodeResources
+	ReservedResources     *NodeReservedResources
+	Links                 map[string]string
+	Meta                  map[string]string
+	NodeClass             string
+	ComputedClass         string
+	Drain                 bool
+	DrainStrategy         *DrainStrategy
+	SchedulingEligibility string
+	Status                string
+	StatusDescription     string
+	StatusUpdatedAt       int64
+	Events                []*NodeEvent
+	Drivers               map[string]*DriverInfo
+	HostVolumes           map[string]*HostVolumeInfo
+	CreateIndex           uint64
+	ModifyIndex           uint64
+}
+
+// NodeEvent is a single entry in a node's event log.
+type NodeEvent struct {
+	Message     string
+	Subsystem   string
+	Details     map[string]string
+	Timestamp   time.Time
+	CreateIndex uint64
+}
+
+// HostVolumeInfo is used to return metadata about a given host volume.
+type HostVolumeInfo struct {
+	Path     string
+	ReadOnly bool
+}
+
+// NodeListStub is a subset of information returned during node list
+// operations.
+type NodeListStub struct {
+	Address               string
+	ID                    string
+	Datacenter            string
+	Name                  string
+	NodeClass             string
+	Version               string
+	Drain                 bool
+	SchedulingEligibility string
+	Status                string
+	StatusDescription     string
+	Drivers               map[string]*DriverInfo
+	HostVolumes           map[string]*HostVolumeInfo
+	CreateIndex           uint64
+	ModifyIndex           uint64
+}
+
+// NodeIndexSort is used to sort node list stubs by create index,
+// descending, so the most recently registered nodes appear first.
+type NodeIndexSort []*NodeListStub
+
+func (n NodeIndexSort) Len() int {
+	return len(n)
+}
+
+func (n NodeIndexSort) Less(i, j int) bool {
+	return n[i].CreateIndex > n[j].CreateIndex
+}
+
+func (n NodeIndexSort) Swap(i, j int) {
+	n[i], n[j] = n[j], n[i]
+}
@@ -0,0 +1,107 @@
+package taskrunner
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocrunner/taskrunner/connectcert"
+	"github.com/hashicorp/nomad/nomad/structs/config"
+)
+
+// rotateMargin is how far ahead of a leaf's NotAfter the rotation goroutine
+// re-issues it, so the task is never caught holding an expired cert.
+const rotateMargin = time.Hour
+
+// autoTLSConfig is the subset of connect.native_auto_tls configuration
+// needed to mint per-allocation Connect Native leaf certificates.
+type autoTLSConfig struct {
+	enabled     bool
+	trustDomain string
+	ttl         time.Duration
+	ca          connectcert.SigningCA
+}
+
+func autoTLSConfigFromAgent(c *config.ConsulConfig) (autoTLSConfig, error) {
+	if c == nil || !c.NativeAutoTLS {
+		return autoTLSConfig{}, nil
+	}
+
+	caCert, err := ioutil.ReadFile(c.NativeAutoTLSCAFile)
+	if err != nil {
+		return autoTLSConfig{}, err
+	}
+
+	caKey, err := ioutil.ReadFile(c.NativeAutoTLSCAKeyFile)
+	if err != nil {
+		return autoTLSConfig{}, err
+	}
+
+	return autoTLSConfig{
+		enabled:     true,
+		trustDomain: c.NativeAutoTLSTrustDomain,
+		ttl:         c.NativeAutoTLSTTL,
+		ca: connectcert.SigningCA{
+			CertPEM: caCert,
+			KeyPEM:  caKey,
+		},
+	}, nil
+}
+
+// mintLeaf generates a fresh leaf keypair for the given service, signed by
+// the configured auto-tls CA.
+func (c *connectNativeHook) mintLeaf(service string) (*connectcert.Material, error) {
+	return connectcert.Generate(connectcert.LeafRequest{
+		TrustDomain: c.autoTLS.trustDomain,
+		Datacenter:  c.datacenter,
+		Service:     service,
+		TTL:         c.autoTLS.ttl,
+	}, c.autoTLS.ca)
+}
+
+// startRotation runs until stopCh is closed, re-issuing the leaf cert
+// rotateMargin before it expires and rewriting it into secretsDir via
+// store.
+func (c *connectNativeHook) startRotation(secretsDir, service string, material *connectcert.Material, stopCh <-chan struct{}) {
+	go func() {
+		current := material
+		for {
+			wait := time.Until(current.NotAfter.Add(-rotateMargin))
+			if wait < 0 {
+				wait = 0
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-stopCh:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			next, err := c.mintLeaf(service)
+			if err != nil {
+				c.logger.Error("failed to rotate connect native leaf certificate", "error", err)
+				// back off and retry rather than leaving the task stranded
+				// on a near-expired cert.
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(time.Minute):
+				}
+				continue
+			}
+
+			if _, err := c.secretsStore.StoreMaterial(secretsDir, next); err != nil {
+				c.logger.Error("failed to write rotated connect native leaf certificate", "error", err)
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(time.Minute):
+				}
+				continue
+			}
+
+			current = next
+		}
+	}()
+}
@@ -0,0 +1,473 @@
+package taskrunner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+	"github.com/hashicorp/nomad/helper/file"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/nomad/structs/config"
+)
+
+const (
+	consulCAFilename   = "consul_ca_file"
+	consulCertFilename = "consul_cert_file"
+	consulKeyFilename  = "consul_key_file"
+
+	// sidsTokenFile is the name of the file in the task's secrets directory
+	// where the Service Identity token is written by the consul envoy/SI
+	// hooks, if one was derived for this task.
+	sidsTokenFile = "si_token"
+
+	// secretsDirPerm is the permission bits used for any missing directory
+	// the atomic writes create on the way to a Connect Native TLS/token
+	// file. An already-existing secrets directory keeps its own mode.
+	secretsDirPerm = 0700
+
+	// secretsFilePerm is the permission bits set on every TLS/token file
+	// this hook writes into the secrets directory.
+	secretsFilePerm = 0600
+)
+
+// consulTransportConfig is the subset of the agent's consul client config
+// that is relevant to configuring a Connect Native task's TLS / auth
+// material.
+type consulTransportConfig struct {
+	Auth      string
+	SSL       string
+	VerifySSL string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+}
+
+func consulTransportConfigFromAgent(c *config.ConsulConfig) consulTransportConfig {
+	if c == nil {
+		return consulTransportConfig{}
+	}
+
+	tc := consulTransportConfig{
+		Auth:     c.Auth,
+		CAFile:   c.CAFile,
+		CertFile: c.CertFile,
+		KeyFile:  c.KeyFile,
+	}
+
+	if c.ShareSSL != nil && *c.ShareSSL {
+		if c.EnableSSL != nil {
+			tc.SSL = fmt.Sprintf("%t", *c.EnableSSL)
+		}
+		if c.VerifySSL != nil {
+			tc.VerifySSL = fmt.Sprintf("%t", *c.VerifySSL)
+		}
+	} else {
+		// Without share_ssl, agent TLS material is not copied into the task.
+		tc.CAFile = ""
+		tc.CertFile = ""
+		tc.KeyFile = ""
+	}
+
+	return tc
+}
+
+// connectNativeHookConfig carries the values needed to construct a
+// connectNativeHook out of the task runner's alloc/client config.
+type connectNativeHookConfig struct {
+	alloc        *structs.Allocation
+	consulConfig *config.ConsulConfig
+	logger       log.Logger
+
+	// vaultToken is the task's own derived Vault token, used by the
+	// connect.native_token_source=vault TokenSource. Set via
+	// WithVaultToken; zero value disables the vault token source
+	// regardless of client config.
+	vaultToken string
+
+	// datacenter is the datacenter of the client node this allocation is
+	// actually placed on, used as the `dc` segment of the Connect Native
+	// leaf cert's SPIFFE SAN. Set via WithDatacenter; the job's allowed
+	// Datacenters list is not a substitute, since a multi-datacenter job
+	// may be placed on a node in any one of them.
+	datacenter string
+}
+
+// connectNativeHookOption customizes a connectNativeHookConfig beyond its
+// required alloc/consulConfig/logger arguments.
+type connectNativeHookOption func(*connectNativeHookConfig)
+
+// WithVaultToken supplies the task's derived Vault token, as produced by
+// the task runner's Vault hook, enabling the vault TokenSource.
+func WithVaultToken(token string) connectNativeHookOption {
+	return func(c *connectNativeHookConfig) {
+		c.vaultToken = token
+	}
+}
+
+// WithDatacenter supplies the datacenter of the client node the allocation
+// is running on, as known by the task runner (not the job's Datacenters
+// constraint, which only narrows where the alloc *could* be placed).
+func WithDatacenter(dc string) connectNativeHookOption {
+	return func(c *connectNativeHookConfig) {
+		c.datacenter = dc
+	}
+}
+
+func newConnectNativeHookConfig(
+	alloc *structs.Allocation,
+	consulConfig *config.ConsulConfig,
+	logger log.Logger,
+	opts ...connectNativeHookOption) *connectNativeHookConfig {
+
+	c := &connectNativeHookConfig{
+		alloc:        alloc,
+		consulConfig: consulConfig,
+		logger:       logger,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// connectNativeHook is a task runner prestart hook that configures a Connect
+// Native task (one using the `consul/api` and `connect` packages directly,
+// without a sidecar proxy) with the TLS and auth material it needs to talk
+// to Consul, and a Consul Service Identity token, if available.
+type connectNativeHook struct {
+	alloc        *structs.Allocation
+	consulConfig consulTransportConfig
+	secretsStore NativeSecretsStore
+	autoTLS      autoTLSConfig
+	autoTLSErr   error
+	datacenter   string
+	rotateStopCh chan struct{}
+
+	tokenSource TokenSource
+	renewStopCh chan struct{}
+
+	// tokenMu guards tokenLease and tokenStopped, which are read from the
+	// renewal goroutine started by startTokenRenewal and written from both
+	// that goroutine and Stop.
+	tokenMu      sync.Mutex
+	tokenLease   *TokenLease
+	tokenStopped bool
+
+	logger log.Logger
+}
+
+func newConnectNativeHook(c *connectNativeHookConfig) *connectNativeHook {
+	autoTLS, autoTLSErr := autoTLSConfigFromAgent(c.consulConfig)
+
+	return &connectNativeHook{
+		alloc:        c.alloc,
+		consulConfig: consulTransportConfigFromAgent(c.consulConfig),
+		secretsStore: newNativeSecretsStore(nativeSecretsBackendFromAgent(c.consulConfig)),
+		autoTLS:      autoTLS,
+		autoTLSErr:   autoTLSErr,
+		datacenter:   c.datacenter,
+		rotateStopCh: make(chan struct{}),
+		tokenSource:  tokenSourceFromAgent(c),
+		renewStopCh:  make(chan struct{}),
+		logger:       c.logger.Named("connect_native"),
+	}
+}
+
+// tokenSourceFromAgent builds the TokenSource this hook should use to
+// obtain CONSUL_HTTP_TOKEN, or nil if connect.native_token_source is unset
+// or the task has no Vault token to authenticate with.
+func tokenSourceFromAgent(c *connectNativeHookConfig) TokenSource {
+	if c.consulConfig == nil || c.consulConfig.NativeTokenSource != tokenSourceVault {
+		return nil
+	}
+	if c.vaultToken == "" {
+		return nil
+	}
+
+	src, err := newVaultTokenSource(c.consulConfig.NativeTokenSourceVaultAddr, c.vaultToken, c.consulConfig.NativeTokenSourceRole)
+	if err != nil {
+		c.logger.Error("failed to configure connect native vault token source", "error", err)
+		return nil
+	}
+	return src
+}
+
+// nativeSecretsBackendFromAgent reads the connect.native_secrets_backend
+// knob out of the agent's consul config, defaulting to tmpfs.
+func nativeSecretsBackendFromAgent(c *config.ConsulConfig) string {
+	if c == nil || c.NativeSecretsBackend == "" {
+		return secretsBackendTmpfs
+	}
+	return c.NativeSecretsBackend
+}
+
+func (*connectNativeHook) Name() string {
+	return "connect_native"
+}
+
+// copyCertificate atomically copies the file at src into dir/filename. If
+// src is empty, it is a no-op (the agent was not configured with that piece
+// of TLS material).
+func (*connectNativeHook) copyCertificate(src, dir, filename string) error {
+	if src == "" {
+		return nil
+	}
+
+	source, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open consul TLS certificate: %w", err)
+	}
+	defer source.Close()
+
+	dest := filepath.Join(dir, filename)
+	if err := file.CopyAtomicWithPerms(source, dest, secretsDirPerm, secretsFilePerm); err != nil {
+		return fmt.Errorf("failed to copy consul TLS certificate: %w", err)
+	}
+
+	return nil
+}
+
+// copyCertificates copies the CA, client cert, and client key configured in
+// tc into dir (the task's secrets directory), each with file mode 0600.
+// Any of the three that are unset are skipped.
+func (c *connectNativeHook) copyCertificates(tc consulTransportConfig, dir string) error {
+	if err := c.copyCertificate(tc.CAFile, dir, consulCAFilename); err != nil {
+		return err
+	}
+	if err := c.copyCertificate(tc.CertFile, dir, consulCertFilename); err != nil {
+		return err
+	}
+	if err := c.copyCertificate(tc.KeyFile, dir, consulKeyFilename); err != nil {
+		return err
+	}
+	return nil
+}
+
+// authEnv computes the CONSUL_HTTP_* environment variables that are
+// independent of where (or whether) TLS material is written to disk. Any
+// key already present in taskEnv (i.e. set explicitly in the task's env
+// stanza) is left alone, since the task author's choice takes precedence.
+func (c *connectNativeHook) authEnv(taskEnv map[string]string) map[string]string {
+	env := make(map[string]string)
+
+	set := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if _, exists := taskEnv[key]; exists {
+			return
+		}
+		env[key] = value
+	}
+
+	set("CONSUL_HTTP_AUTH", c.consulConfig.Auth)
+	set("CONSUL_HTTP_SSL", c.consulConfig.SSL)
+	set("CONSUL_HTTP_SSL_VERIFY", c.consulConfig.VerifySSL)
+
+	return env
+}
+
+// tlsEnv computes the CONSUL_* environment variables this hook would like
+// to set, given the hook's agent-derived consul config, assuming the
+// tmpfsNativeSecretsStore file layout. Callers using a different
+// NativeSecretsStore should merge that store's own env instead of the
+// CONSUL_CACERT/CONSUL_CLIENT_CERT/CONSUL_CLIENT_KEY entries computed here.
+func (c *connectNativeHook) tlsEnv(taskEnv map[string]string) map[string]string {
+	env := c.authEnv(taskEnv)
+
+	set := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if _, exists := taskEnv[key]; exists {
+			return
+		}
+		env[key] = value
+	}
+
+	if c.consulConfig.CAFile != "" {
+		set("CONSUL_CACERT", filepath.Join("/secrets", consulCAFilename))
+	}
+	if c.consulConfig.CertFile != "" {
+		set("CONSUL_CLIENT_CERT", filepath.Join("/secrets", consulCertFilename))
+	}
+	if c.consulConfig.KeyFile != "" {
+		set("CONSUL_CLIENT_KEY", filepath.Join("/secrets", consulKeyFilename))
+	}
+
+	return env
+}
+
+// siToken reads a previously-derived Service Identity token out of the
+// task's secrets directory, if one is present.
+func (*connectNativeHook) siToken(secretsDir string) (string, error) {
+	path := filepath.Join(secretsDir, sidsTokenFile)
+
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to read SI token: %w", err)
+	}
+
+	return string(b), nil
+}
+
+func (c *connectNativeHook) Prestart(
+	_ context.Context,
+	request *interfaces.TaskPrestartRequest,
+	response *interfaces.TaskPrestartResponse) error {
+
+	response.Done = true
+
+	if !request.Task.Kind.IsConnectNative() {
+		return nil
+	}
+
+	secretsDir := request.TaskDir.SecretsDir
+
+	switch {
+	case c.tokenSource != nil:
+		if err := c.deriveToken(secretsDir); err != nil {
+			return err
+		}
+		lease := c.currentTokenLease()
+		if lease == nil {
+			// deriveToken only returns nil once the lease is installed,
+			// but guard anyway rather than risk a nil-deref panic here.
+			return fmt.Errorf("connect native consul token lease missing after derive")
+		}
+		if response.Env == nil {
+			response.Env = make(map[string]string)
+		}
+		response.Env["CONSUL_HTTP_TOKEN"] = lease.Token
+		c.startTokenRenewal(secretsDir, c.renewStopCh)
+
+	default:
+		if token, err := c.siToken(secretsDir); err != nil {
+			return err
+		} else if token != "" {
+			if response.Env == nil {
+				response.Env = make(map[string]string)
+			}
+			response.Env["CONSUL_HTTP_TOKEN"] = token
+		}
+	}
+
+	var existingEnv map[string]string
+	if request.TaskEnv != nil {
+		existingEnv = request.TaskEnv.EnvMap
+	}
+
+	var certEnv map[string]string
+
+	switch {
+	case c.consulConfig.SSL != "" || c.consulConfig.CAFile != "":
+		// share_ssl: copy the agent's own TLS material into the task.
+		var err error
+		certEnv, err = c.secretsStore.Store(secretsDir, c.consulConfig)
+		if err != nil {
+			return err
+		}
+
+	case c.autoTLS.enabled:
+		// connect.native_auto_tls: mint a fresh per-allocation leaf instead.
+		service := request.Task.Kind.Value()
+
+		material, err := c.mintLeaf(service)
+		if err != nil {
+			return fmt.Errorf("failed to mint connect native leaf certificate: %w", err)
+		}
+
+		certEnv, err = c.secretsStore.StoreMaterial(secretsDir, material)
+		if err != nil {
+			return err
+		}
+
+		c.startRotation(secretsDir, service, material, c.rotateStopCh)
+
+		// native_auto_tls always implies TLS is in use, unlike share_ssl
+		// which carries its enable/verify bits over from the agent config.
+		if c.consulConfig.SSL == "" {
+			c.consulConfig.SSL = "true"
+		}
+		if c.consulConfig.VerifySSL == "" {
+			c.consulConfig.VerifySSL = "true"
+		}
+
+	case c.autoTLSErr != nil:
+		return fmt.Errorf("connect.native_auto_tls misconfigured: %w", c.autoTLSErr)
+
+	default:
+		// Neither share_ssl nor native_auto_tls configured for this task.
+		return nil
+	}
+
+	env := c.authEnv(existingEnv)
+	for k, v := range certEnv {
+		if _, exists := existingEnv[k]; exists {
+			continue
+		}
+		env[k] = v
+	}
+
+	if len(env) > 0 {
+		if response.Env == nil {
+			response.Env = make(map[string]string)
+		}
+		for k, v := range env {
+			response.Env[k] = v
+		}
+	}
+
+	return nil
+}
+
+// Stop implements interfaces.TaskStopHook. It halts the native_auto_tls
+// rotation goroutine and the dynamic token renewer, if either was started
+// for this task, and revokes any outstanding token lease.
+func (c *connectNativeHook) Stop(ctx context.Context, _ *interfaces.TaskStopRequest, _ *interfaces.TaskStopResponse) error {
+	select {
+	case <-c.rotateStopCh:
+		// already stopped
+	default:
+		close(c.rotateStopCh)
+	}
+
+	select {
+	case <-c.renewStopCh:
+		// already stopped
+	default:
+		close(c.renewStopCh)
+	}
+
+	if c.tokenSource != nil {
+		// stopTokenRenewal marks the lease as no longer renewable and
+		// hands back whatever lease was current at that moment, so a
+		// renewal racing this Stop call either installed its lease
+		// first (and that lease is the one revoked here) or loses (and
+		// revokes the replacement it just obtained itself, in addition
+		// to the lease revoked here) — either way no lease is left live.
+		if lease := c.stopTokenRenewal(); lease != nil {
+			if err := c.tokenSource.Revoke(ctx, lease); err != nil {
+				c.logger.Error("failed to revoke connect native consul token lease", "error", err)
+				return err
+			}
+		}
+	}
+
+	if c.secretsStore != nil {
+		if err := c.secretsStore.Close(); err != nil {
+			c.logger.Error("failed to close connect native secrets store", "error", err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,10 +2,20 @@ package taskrunner
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	consultest "github.com/hashicorp/consul/sdk/testutil"
@@ -15,6 +25,7 @@ import (
 	"github.com/hashicorp/nomad/client/testutil"
 	agentconsul "github.com/hashicorp/nomad/command/agent/consul"
 	"github.com/hashicorp/nomad/helper"
+	"github.com/hashicorp/nomad/helper/file"
 	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/helper/uuid"
 	"github.com/hashicorp/nomad/nomad/mock"
@@ -23,6 +34,30 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// faultyCertReader returns n bytes successfully and then fails, simulating
+// the process dying partway through copying TLS material into place.
+type faultyCertReader struct {
+	data []byte
+	n    int
+}
+
+func (r *faultyCertReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("injected fault")
+	}
+	k := len(p)
+	if k > r.n {
+		k = r.n
+	}
+	if k > len(r.data) {
+		k = len(r.data)
+	}
+	copy(p, r.data[:k])
+	r.data = r.data[k:]
+	r.n -= k
+	return k, nil
+}
+
 func getTestConsul(t *testing.T) *consultest.TestServer {
 	testConsul, err := consultest.NewTestServerConfig(func(c *consultest.TestServerConfig) {
 		if !testing.Verbose() { // disable consul logging if -v not set
@@ -108,6 +143,48 @@ func TestConnectNativeHook_copyCertificates(t *testing.T) {
 	})
 }
 
+func TestConnectNativeHook_copyCertificates_modebits(t *testing.T) {
+	t.Parallel()
+
+	f, d := setupCertDirs(t)
+	defer cleanupCertDirs(t, f, d)
+
+	err := new(connectNativeHook).copyCertificates(consulTransportConfig{
+		CAFile:   f,
+		CertFile: f,
+		KeyFile:  f,
+	}, d)
+	require.NoError(t, err)
+
+	for _, name := range []string{consulCAFilename, consulCertFilename, consulKeyFilename} {
+		fi, err := os.Stat(filepath.Join(d, name))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "mode of %s", name)
+	}
+}
+
+func TestConnectNativeHook_copyCertificate_atomic(t *testing.T) {
+	t.Parallel()
+
+	_, d := setupCertDirs(t)
+	defer os.RemoveAll(d)
+
+	dest := filepath.Join(d, "out.pem")
+
+	// Simulate a process death partway through writing the certificate: the
+	// fault-injecting reader fails after 4 of 27 bytes. The destination
+	// file must never appear, not even truncated.
+	src := &faultyCertReader{data: []byte("-----BEGIN CERTIFICATE-----"), n: 4}
+	err := file.CopyAtomicWithPerms(src, dest, secretsDirPerm, secretsFilePerm)
+	require.Error(t, err)
+
+	_, err = os.Stat(dest)
+	require.True(t, os.IsNotExist(err), "destination must not exist after a failed copy")
+
+	_, err = os.Stat(dest + ".tmp")
+	require.True(t, os.IsNotExist(err), "temp file must be cleaned up after a failed copy")
+}
+
 func TestConnectNativeHook_tlsEnv(t *testing.T) {
 	t.Parallel()
 
@@ -303,10 +380,11 @@ func TestTaskRunner_ConnectNativeHook_with_SI_token(t *testing.T) {
 	}
 	require.NoError(t, request.TaskDir.Build(false, nil))
 
-	// Insert service identity token in the secrets directory
+	// Insert service identity token in the secrets directory, the way the
+	// SI token hook does: an atomic write with tightly restricted perms.
 	token := uuid.Generate()
 	siTokenFile := filepath.Join(request.TaskDir.SecretsDir, sidsTokenFile)
-	err = ioutil.WriteFile(siTokenFile, []byte(token), 0440)
+	err = file.WriteAtomicWithPerms(siTokenFile, []byte(token), secretsDirPerm, secretsFilePerm)
 	require.NoError(t, err)
 
 	response := new(interfaces.TaskPrestartResponse)
@@ -326,6 +404,11 @@ func TestTaskRunner_ConnectNativeHook_with_SI_token(t *testing.T) {
 	ls, err := ioutil.ReadDir(request.TaskDir.SecretsDir)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(ls))
+
+	// Assert the SI token file mode is tightly restricted
+	fi, err := os.Stat(siTokenFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
 }
 
 func TestTaskRunner_ConnectNativeHook_shareTLS(t *testing.T) {
@@ -405,10 +488,13 @@ func TestTaskRunner_ConnectNativeHook_shareTLS(t *testing.T) {
 		"CONSUL_HTTP_SSL_VERIFY": "true",
 	}, response.Env)
 
-	// Assert 3 pem files were written
+	// Assert 3 pem files were written, each with tightly restricted perms
 	ls, err := ioutil.ReadDir(request.TaskDir.SecretsDir)
 	require.NoError(t, err)
 	require.Equal(t, 3, len(ls))
+	for _, fi := range ls {
+		require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "mode of %s", fi.Name())
+	}
 }
 
 func TestTaskRunner_ConnectNativeHook_shareTLS_override(t *testing.T) {
@@ -501,3 +587,305 @@ func TestTaskRunner_ConnectNativeHook_shareTLS_override(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 3, len(ls))
 }
+
+func TestTaskRunner_ConnectNativeHook_shareTLS_memoryBackend(t *testing.T) {
+	t.Parallel()
+	testutil.RequireConsul(t)
+
+	fakeCert, fakeCertDir := setupCertDirs(t)
+	defer cleanupCertDirs(t, fakeCert, fakeCertDir)
+
+	testConsul := getTestConsul(t)
+	defer testConsul.Stop()
+
+	alloc := mock.Alloc()
+	alloc.AllocatedResources.Shared.Networks = []*structs.NetworkResource{{Mode: "host", IP: "1.1.1.1"}}
+	tg := alloc.Job.TaskGroups[0]
+	tg.Services = []*structs.Service{{
+		Name: "cn-service",
+		Connect: &structs.ConsulConnect{
+			Native: tg.Tasks[0].Name,
+		}},
+	}
+	tg.Tasks[0].Kind = structs.NewTaskKind("connect-native", "cn-service")
+
+	logger := testlog.HCLogger(t)
+
+	allocDir, cleanup := allocdir.TestAllocDir(t, logger, "ConnectNative")
+	defer cleanup()
+
+	// register group services
+	consulConfig := consulapi.DefaultConfig()
+	consulConfig.Address = testConsul.HTTPAddr
+	consulAPIClient, err := consulapi.NewClient(consulConfig)
+	require.NoError(t, err)
+
+	consulClient := agentconsul.NewServiceClient(consulAPIClient.Agent(), logger, true)
+	go consulClient.Run()
+	defer consulClient.Shutdown()
+	require.NoError(t, consulClient.RegisterWorkload(agentconsul.BuildAllocServices(mock.Node(), alloc, agentconsul.NoopRestarter())))
+
+	// Run Connect Native hook with the memory secrets backend selected
+	h := newConnectNativeHook(newConnectNativeHookConfig(alloc, &config.ConsulConfig{
+		Addr: consulConfig.Address,
+
+		// TLS config consumed by native application
+		ShareSSL:             helper.BoolToPtr(true),
+		EnableSSL:            helper.BoolToPtr(true),
+		VerifySSL:            helper.BoolToPtr(true),
+		CAFile:               fakeCert,
+		CertFile:             fakeCert,
+		KeyFile:              fakeCert,
+		Auth:                 "user:password",
+		NativeSecretsBackend: "memory",
+	}, logger))
+	request := &interfaces.TaskPrestartRequest{
+		Task:    tg.Tasks[0],
+		TaskDir: allocDir.NewTaskDir(tg.Tasks[0].Name),
+		TaskEnv: taskenv.NewEmptyTaskEnv(),
+	}
+	require.NoError(t, request.TaskDir.Build(false, nil))
+
+	response := new(interfaces.TaskPrestartResponse)
+	response.Env = make(map[string]string)
+
+	// Run the Connect Native hook
+	require.NoError(t, h.Prestart(context.Background(), request, response))
+
+	// Assert the hook is Done
+	require.True(t, response.Done)
+
+	// Assert the non-sensitive CA/cert were set inline, and the key was
+	// handed off via a socket rather than placed in the environment.
+	require.NotEmpty(t, response.Env)
+	require.Equal(t, map[string]string{
+		"CONSUL_CACERT_PEM":        "ABCDEF",
+		"CONSUL_CLIENT_CERT_PEM":   "ABCDEF",
+		"CONSUL_CLIENT_KEY_SOCKET": "/secrets/" + consulKeySocketFilename,
+		"CONSUL_HTTP_AUTH":         "user:password",
+		"CONSUL_HTTP_SSL":          "true",
+		"CONSUL_HTTP_SSL_VERIFY":   "true",
+	}, response.Env)
+
+	// Assert the memory backend never wrote the key material to a regular
+	// file: the only filesystem entry is the socket it's served over.
+	ls, err := ioutil.ReadDir(request.TaskDir.SecretsDir)
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	require.Equal(t, consulKeySocketFilename, ls[0].Name())
+
+	// Assert the key itself is retrievable by connecting to that socket,
+	// and that the listener stays up for a second connection too (it is
+	// not a one-shot handoff, so a rotated key can also be redelivered).
+	sockPath := filepath.Join(request.TaskDir.SecretsDir, consulKeySocketFilename)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", sockPath)
+		require.NoError(t, err)
+		key, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "ABCDEF", string(key))
+		conn.Close()
+	}
+
+	// Stop must close the listener so its accept-loop goroutine exits and
+	// further connections fail, rather than leaking for the life of the
+	// client process.
+	require.NoError(t, h.Stop(context.Background(), nil, nil))
+	_, err = net.Dial("unix", sockPath)
+	require.Error(t, err, "socket must be closed once the hook has stopped")
+}
+
+// setupAutoTLSCA writes a self-signed ECDSA CA cert+key pair to disk and
+// returns their paths, for use as a connect.native_auto_tls signing CA.
+func setupAutoTLSCA(t *testing.T) (caFile, caKeyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test connect native CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "connect_native_autotls_ca")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	caFile = filepath.Join(dir, "ca.pem")
+	caKeyFile = filepath.Join(dir, "ca-key.pem")
+
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return caFile, caKeyFile
+}
+
+func TestTaskRunner_ConnectNativeHook_autoTLS(t *testing.T) {
+	t.Parallel()
+
+	caFile, caKeyFile := setupAutoTLSCA(t)
+
+	alloc := mock.Alloc()
+	// The job is eligible to run in any of three datacenters; the
+	// allocation is actually placed on a node in the last one, not the
+	// first. The SAN must reflect where the alloc is really running, not
+	// the job's Datacenters[0].
+	alloc.Job.Datacenters = []string{"dc1", "dc2", "dc3"}
+	placedDatacenter := "dc3"
+	tg := alloc.Job.TaskGroups[0]
+	tg.Services = []*structs.Service{{
+		Name: "cn-service",
+		Connect: &structs.ConsulConnect{
+			Native: tg.Tasks[0].Name,
+		}},
+	}
+	tg.Tasks[0].Kind = structs.NewTaskKind("connect-native", "cn-service")
+
+	logger := testlog.HCLogger(t)
+
+	allocDir, cleanup := allocdir.TestAllocDir(t, logger, "ConnectNativeAutoTLS")
+	defer cleanup()
+
+	h := newConnectNativeHook(newConnectNativeHookConfig(alloc, &config.ConsulConfig{
+		Addr: "http://127.0.0.2:1",
+
+		NativeAutoTLS:            true,
+		NativeAutoTLSCAFile:      caFile,
+		NativeAutoTLSCAKeyFile:   caKeyFile,
+		NativeAutoTLSTrustDomain: "test.consul",
+		NativeAutoTLSTTL:         2 * time.Second,
+	}, logger, WithDatacenter(placedDatacenter)))
+	defer h.Stop(context.Background(), nil, nil)
+
+	request := &interfaces.TaskPrestartRequest{
+		Task:    tg.Tasks[0],
+		TaskDir: allocDir.NewTaskDir(tg.Tasks[0].Name),
+	}
+	require.NoError(t, request.TaskDir.Build(false, nil))
+
+	response := new(interfaces.TaskPrestartResponse)
+	response.Env = make(map[string]string)
+
+	require.NoError(t, h.Prestart(context.Background(), request, response))
+	require.True(t, response.Done)
+
+	// Assert SSL env was turned on implicitly, and the cert paths point
+	// into the secrets dir.
+	require.Equal(t, "true", response.Env["CONSUL_HTTP_SSL"])
+	require.Equal(t, "/secrets/"+consulCertFilename, response.Env["CONSUL_CLIENT_CERT"])
+
+	certPath := filepath.Join(request.TaskDir.SecretsDir, consulCertFilename)
+
+	// Assert mode bits on every generated file.
+	for _, name := range []string{consulCAFilename, consulCertFilename, consulKeyFilename} {
+		fi, err := os.Stat(filepath.Join(request.TaskDir.SecretsDir, name))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "mode of %s", name)
+	}
+
+	// Assert SAN correctness.
+	readLeaf := func() *x509.Certificate {
+		b, err := ioutil.ReadFile(certPath)
+		require.NoError(t, err)
+		block, _ := pem.Decode(b)
+		require.NotNil(t, block)
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		return leaf
+	}
+
+	leaf := readLeaf()
+	require.Len(t, leaf.URIs, 1)
+	require.Equal(t, "spiffe://test.consul/ns/default/dc/"+placedDatacenter+"/svc/cn-service", leaf.URIs[0].String())
+	firstSerial := leaf.SerialNumber
+
+	// Assert rotation fires: the TTL is 2s (less than the 1h rotation
+	// margin), so the rotation goroutine should re-issue almost
+	// immediately, producing a new serial number.
+	require.Eventually(t, func() bool {
+		return readLeaf().SerialNumber.Cmp(firstSerial) != 0
+	}, 10*time.Second, 100*time.Millisecond, "expected leaf certificate to rotate")
+}
+
+// TestTaskRunner_ConnectNativeHook_autoTLS_memoryBackend_rotationRedelivers
+// combines connect.native_auto_tls with native_secrets_backend=memory: the
+// rotation goroutine calls StoreMaterial on every rotation cycle, and the
+// memory backend's key socket must actually redeliver the rotated key, not
+// just the one the task happened to read at Prestart.
+func TestTaskRunner_ConnectNativeHook_autoTLS_memoryBackend_rotationRedelivers(t *testing.T) {
+	t.Parallel()
+
+	caFile, caKeyFile := setupAutoTLSCA(t)
+
+	alloc := mock.Alloc()
+	tg := alloc.Job.TaskGroups[0]
+	tg.Services = []*structs.Service{{
+		Name: "cn-service",
+		Connect: &structs.ConsulConnect{
+			Native: tg.Tasks[0].Name,
+		}},
+	}
+	tg.Tasks[0].Kind = structs.NewTaskKind("connect-native", "cn-service")
+
+	logger := testlog.HCLogger(t)
+
+	allocDir, cleanup := allocdir.TestAllocDir(t, logger, "ConnectNativeAutoTLSMemory")
+	defer cleanup()
+
+	h := newConnectNativeHook(newConnectNativeHookConfig(alloc, &config.ConsulConfig{
+		Addr: "http://127.0.0.2:1",
+
+		NativeAutoTLS:            true,
+		NativeAutoTLSCAFile:      caFile,
+		NativeAutoTLSCAKeyFile:   caKeyFile,
+		NativeAutoTLSTrustDomain: "test.consul",
+		NativeAutoTLSTTL:         2 * time.Second,
+		NativeSecretsBackend:     "memory",
+	}, logger))
+	defer h.Stop(context.Background(), nil, nil)
+
+	request := &interfaces.TaskPrestartRequest{
+		Task:    tg.Tasks[0],
+		TaskDir: allocDir.NewTaskDir(tg.Tasks[0].Name),
+	}
+	require.NoError(t, request.TaskDir.Build(false, nil))
+
+	response := new(interfaces.TaskPrestartResponse)
+	response.Env = make(map[string]string)
+
+	require.NoError(t, h.Prestart(context.Background(), request, response))
+	require.True(t, response.Done)
+	require.Equal(t, "/secrets/"+consulKeySocketFilename, response.Env["CONSUL_CLIENT_KEY_SOCKET"])
+
+	sockPath := filepath.Join(request.TaskDir.SecretsDir, consulKeySocketFilename)
+	readKey := func() string {
+		conn, err := net.Dial("unix", sockPath)
+		require.NoError(t, err)
+		defer conn.Close()
+		b, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	firstKey := readKey()
+	require.NotEmpty(t, firstKey)
+
+	// The TTL is 2s (less than the 1h rotation margin), so rotation should
+	// re-issue almost immediately. A fresh connection must see the new
+	// key, not the one captured at Prestart.
+	require.Eventually(t, func() bool {
+		return readKey() != firstKey
+	}, 10*time.Second, 100*time.Millisecond, "expected the rotated key to be redelivered over the socket")
+}
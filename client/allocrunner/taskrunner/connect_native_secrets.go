@@ -0,0 +1,254 @@
+package taskrunner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/nomad/client/allocrunner/taskrunner/connectcert"
+	"github.com/hashicorp/nomad/helper/file"
+)
+
+const (
+	// secretsBackendTmpfs writes CA/cert/key material into the task's
+	// SecretsDir, the historical and default behavior.
+	secretsBackendTmpfs = "tmpfs"
+
+	// secretsBackendMemory keeps CA/cert/key material in memory only. The
+	// CA and certificate, which are not sensitive, are handed to the task
+	// inline via CONSUL_*_PEM environment variables; the private key is
+	// handed over consulKeySocketFilename instead, since env vars are
+	// visible via /proc/<pid>/environ and inherited by child processes.
+	secretsBackendMemory = "memory"
+
+	// consulKeySocketFilename is the unix socket the memory backend serves
+	// the private key over for the life of the task, created in the task's
+	// SecretsDir (so only that task's filesystem namespace can reach it).
+	consulKeySocketFilename = "consul_key.sock"
+)
+
+// NativeSecretsStore provisions the Consul TLS material referenced by a
+// consulTransportConfig for a Connect Native task, and reports back the
+// CONSUL_* environment variables the task needs in order to find it.
+//
+// Implementations are free to materialize the CA/cert/key on disk, keep
+// them in memory, or hand them to the task by some other out-of-band
+// mechanism, as long as the returned env vars are sufficient for the
+// consul-native SDK in the task to locate them.
+type NativeSecretsStore interface {
+	Store(secretsDir string, tc consulTransportConfig) (map[string]string, error)
+
+	// StoreMaterial persists an auto-generated (connect.native_auto_tls)
+	// leaf keypair, the same way Store persists agent-copied material, and
+	// is also used to rewrite it in place on rotation.
+	StoreMaterial(secretsDir string, material *connectcert.Material) (map[string]string, error)
+
+	// Close releases any resources (goroutines, listeners, file handles)
+	// the store opened on behalf of the task. Called from the hook's Stop.
+	Close() error
+}
+
+// newNativeSecretsStore selects a NativeSecretsStore implementation given
+// the client's connect.native_secrets_backend configuration. An unset or
+// unrecognized backend defaults to tmpfs, to preserve historical behavior.
+func newNativeSecretsStore(backend string) NativeSecretsStore {
+	switch backend {
+	case secretsBackendMemory:
+		return &memoryNativeSecretsStore{}
+	default:
+		return &tmpfsNativeSecretsStore{}
+	}
+}
+
+// tmpfsNativeSecretsStore is the original backend: it atomically copies the
+// agent's CA/cert/key files into the task's SecretsDir and points the task
+// at those paths.
+type tmpfsNativeSecretsStore struct{}
+
+func (*tmpfsNativeSecretsStore) Store(secretsDir string, tc consulTransportConfig) (map[string]string, error) {
+	if err := new(connectNativeHook).copyCertificates(tc, secretsDir); err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	if tc.CAFile != "" {
+		env["CONSUL_CACERT"] = "/secrets/" + consulCAFilename
+	}
+	if tc.CertFile != "" {
+		env["CONSUL_CLIENT_CERT"] = "/secrets/" + consulCertFilename
+	}
+	if tc.KeyFile != "" {
+		env["CONSUL_CLIENT_KEY"] = "/secrets/" + consulKeyFilename
+	}
+	return env, nil
+}
+
+func (*tmpfsNativeSecretsStore) StoreMaterial(secretsDir string, material *connectcert.Material) (map[string]string, error) {
+	writes := []struct {
+		name string
+		data []byte
+	}{
+		{consulCAFilename, material.CA},
+		{consulCertFilename, material.Cert},
+		{consulKeyFilename, material.Key},
+	}
+
+	for _, w := range writes {
+		path := filepath.Join(secretsDir, w.name)
+		if err := file.WriteAtomicWithPerms(path, w.data, secretsDirPerm, secretsFilePerm); err != nil {
+			return nil, fmt.Errorf("failed to write connect native leaf certificate: %w", err)
+		}
+	}
+
+	return map[string]string{
+		"CONSUL_CACERT":      "/secrets/" + consulCAFilename,
+		"CONSUL_CLIENT_CERT": "/secrets/" + consulCertFilename,
+		"CONSUL_CLIENT_KEY":  "/secrets/" + consulKeyFilename,
+	}, nil
+}
+
+func (*tmpfsNativeSecretsStore) Close() error {
+	return nil
+}
+
+// memoryNativeSecretsStore never writes the CA, certificate, or key to the
+// task's filesystem. The CA and certificate are not sensitive and are
+// handed to the task inline via PEM environment variables; the private
+// key is handed over a unix socket instead (see serveKey), so it never
+// appears in the task's environment.
+//
+// One memoryNativeSecretsStore is constructed per task (newNativeSecretsStore
+// is called once from newConnectNativeHook), so the listener and key it
+// holds are scoped to that task's lifetime and torn down by Close.
+type memoryNativeSecretsStore struct {
+	mu       sync.Mutex
+	key      []byte
+	listener net.Listener
+}
+
+func (m *memoryNativeSecretsStore) Store(secretsDir string, tc consulTransportConfig) (map[string]string, error) {
+	env := make(map[string]string)
+
+	read := func(path string) ([]byte, error) {
+		if path == "" {
+			return nil, nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read consul TLS certificate: %w", err)
+		}
+		return b, nil
+	}
+
+	ca, err := read(tc.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		env["CONSUL_CACERT_PEM"] = string(ca)
+	}
+
+	cert, err := read(tc.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		env["CONSUL_CLIENT_CERT_PEM"] = string(cert)
+	}
+
+	key, err := read(tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		sockPath, err := m.serveKey(secretsDir, key)
+		if err != nil {
+			return nil, err
+		}
+		env["CONSUL_CLIENT_KEY_SOCKET"] = sockPath
+	}
+
+	return env, nil
+}
+
+func (m *memoryNativeSecretsStore) StoreMaterial(secretsDir string, material *connectcert.Material) (map[string]string, error) {
+	sockPath, err := m.serveKey(secretsDir, material.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"CONSUL_CACERT_PEM":        string(material.CA),
+		"CONSUL_CLIENT_CERT_PEM":   string(material.Cert),
+		"CONSUL_CLIENT_KEY_SOCKET": sockPath,
+	}, nil
+}
+
+// serveKey records key as the material to hand out over the unix socket at
+// consulKeySocketFilename inside secretsDir, starting the listener on the
+// first call. Unlike a one-shot handoff, the listener stays up for the
+// life of the task and answers every connection with whatever key is
+// current at that moment: this is what lets connect.native_auto_tls
+// rotation (which calls StoreMaterial again on every rotation cycle) for
+// native_secrets_backend=memory actually redeliver the new key, instead of
+// only ever serving the one the task happened to read at Prestart.
+func (m *memoryNativeSecretsStore) serveKey(secretsDir string, key []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.key = key
+	if m.listener != nil {
+		return "/secrets/" + consulKeySocketFilename, nil
+	}
+
+	sockPath := filepath.Join(secretsDir, consulKeySocketFilename)
+	_ = os.Remove(sockPath)
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open consul client key socket: %w", err)
+	}
+	if err := os.Chmod(sockPath, secretsFilePerm); err != nil {
+		l.Close()
+		return "", fmt.Errorf("failed to set consul client key socket permissions: %w", err)
+	}
+	m.listener = l
+
+	go func() {
+		defer os.Remove(sockPath)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Close (called from Stop) closed the listener; exit.
+				return
+			}
+
+			m.mu.Lock()
+			current := m.key
+			m.mu.Unlock()
+
+			conn.Write(current)
+			conn.Close()
+		}
+	}()
+
+	return "/secrets/" + consulKeySocketFilename, nil
+}
+
+// Close shuts down the key socket's listener, if Store/StoreMaterial ever
+// started one, so its accept loop goroutine exits instead of idling for
+// the rest of the client process's life.
+func (m *memoryNativeSecretsStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.listener == nil {
+		return nil
+	}
+	err := m.listener.Close()
+	m.listener = nil
+	return err
+}
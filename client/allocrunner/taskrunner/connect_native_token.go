@@ -0,0 +1,252 @@
+package taskrunner
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+
+	"github.com/hashicorp/nomad/helper/file"
+)
+
+const (
+	// tokenSourceVault selects the Vault-backed dynamic Consul token
+	// source via connect.native_token_source = "vault".
+	tokenSourceVault = "vault"
+
+	// dynamicTokenFile is the name of the file in the task's secrets
+	// directory where a TokenSource-derived token is written, mirroring
+	// sidsTokenFile for the legacy static SI token.
+	dynamicTokenFile = "consul_token"
+
+	// tokenRenewMinWait puts a floor under how eagerly the renewer retries,
+	// so a TokenSource returning a very short or zero TTL can't spin it.
+	tokenRenewMinWait = time.Second
+)
+
+// TokenLease is a Consul ACL token obtained from a TokenSource, along with
+// enough bookkeeping to renew or revoke it later.
+type TokenLease struct {
+	Token    string
+	LeaseID  string
+	TTL      time.Duration
+	IssuedAt time.Time
+}
+
+// renewAt is when the background renewer should next attempt to renew
+// this lease: halfway through its TTL.
+func (l *TokenLease) renewAt() time.Time {
+	return l.IssuedAt.Add(l.TTL / 2)
+}
+
+// TokenSource abstracts how a Connect Native task obtains the Consul ACL
+// token it uses for CONSUL_HTTP_TOKEN. The static-SI-token case (see
+// siToken) remains the default; TokenSource is used for backends, such as
+// Vault, that mint a short-lived, revocable token instead.
+type TokenSource interface {
+	// Derive obtains a fresh token and lease.
+	Derive(ctx context.Context) (*TokenLease, error)
+
+	// Renew extends an existing lease, returning the (possibly updated)
+	// lease to continue using.
+	Renew(ctx context.Context, lease *TokenLease) (*TokenLease, error)
+
+	// Revoke releases a lease. Called when the task stops.
+	Revoke(ctx context.Context, lease *TokenLease) error
+}
+
+// vaultTokenSource derives short-lived Consul tokens from Vault's Consul
+// secrets engine (`consul/creds/<role>`), using the task's own Vault
+// token.
+type vaultTokenSource struct {
+	client *vaultapi.Client
+	role   string
+}
+
+// newVaultTokenSource builds a TokenSource that talks to Vault at addr,
+// authenticated as vaultToken (the token the Vault hook already derived
+// for this task), to read Consul creds for role.
+func newVaultTokenSource(addr, vaultToken, role string) (*vaultTokenSource, error) {
+	cfg := vaultapi.DefaultConfig()
+	if addr != "" {
+		cfg.Address = addr
+	}
+
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault client for connect native token source: %w", err)
+	}
+	client.SetToken(vaultToken)
+
+	return &vaultTokenSource{client: client, role: role}, nil
+}
+
+func (v *vaultTokenSource) Derive(_ context.Context) (*TokenLease, error) {
+	path := fmt.Sprintf("consul/creds/%s", v.role)
+
+	secret, err := v.client.Logical().Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive consul token from vault: %w", err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("vault returned no secret at %s", path)
+	}
+
+	token, ok := secret.Data["token"].(string)
+	if !ok || token == "" {
+		return nil, fmt.Errorf("vault secret at %s did not contain a token", path)
+	}
+
+	return &TokenLease{
+		Token:    token,
+		LeaseID:  secret.LeaseID,
+		TTL:      time.Duration(secret.LeaseDuration) * time.Second,
+		IssuedAt: time.Now(),
+	}, nil
+}
+
+func (v *vaultTokenSource) Renew(_ context.Context, lease *TokenLease) (*TokenLease, error) {
+	secret, err := v.client.Sys().Renew(lease.LeaseID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew consul token lease %s: %w", lease.LeaseID, err)
+	}
+
+	return &TokenLease{
+		Token:    lease.Token,
+		LeaseID:  secret.LeaseID,
+		TTL:      time.Duration(secret.LeaseDuration) * time.Second,
+		IssuedAt: time.Now(),
+	}, nil
+}
+
+func (v *vaultTokenSource) Revoke(_ context.Context, lease *TokenLease) error {
+	if lease == nil || lease.LeaseID == "" {
+		return nil
+	}
+	if err := v.client.Sys().Revoke(lease.LeaseID); err != nil {
+		return fmt.Errorf("failed to revoke consul token lease %s: %w", lease.LeaseID, err)
+	}
+	return nil
+}
+
+// deriveToken fetches an initial token from c.tokenSource, writes it into
+// secretsDir, and records the lease for later renewal/revocation. If Stop
+// has already run by the time the lease is ready (the alloc was killed
+// while this was still in flight), the lease is revoked immediately
+// instead of being installed, so it is never left outstanding.
+func (c *connectNativeHook) deriveToken(secretsDir string) error {
+	lease, err := c.tokenSource.Derive(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to derive connect native consul token: %w", err)
+	}
+
+	if err := c.writeToken(secretsDir, lease); err != nil {
+		return err
+	}
+
+	if !c.setTokenLease(lease) {
+		if err := c.tokenSource.Revoke(context.Background(), lease); err != nil {
+			c.logger.Error("failed to revoke connect native consul token lease after stop", "error", err)
+		}
+		return fmt.Errorf("connect native hook stopped before the consul token could be installed")
+	}
+	return nil
+}
+
+// currentTokenLease returns the lease currently in effect, if any.
+func (c *connectNativeHook) currentTokenLease() *TokenLease {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.tokenLease
+}
+
+// setTokenLease installs lease as the current one, unless Stop has already
+// run (stopTokenRenewal), in which case it leaves the lease unset and
+// reports that the install did not happen so the caller can revoke lease
+// itself instead of letting it leak.
+func (c *connectNativeHook) setTokenLease(lease *TokenLease) (installed bool) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.tokenStopped {
+		return false
+	}
+	c.tokenLease = lease
+	return true
+}
+
+// stopTokenRenewal marks the lease as no longer renewable and returns the
+// lease in effect at that moment, if any, for the caller (Stop) to revoke.
+// Once this returns, a concurrent renewal that has already fetched a
+// replacement lease will fail to install it via setTokenLease and must
+// revoke that replacement itself, so no lease is left outstanding.
+func (c *connectNativeHook) stopTokenRenewal() *TokenLease {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	c.tokenStopped = true
+	return c.tokenLease
+}
+
+func (c *connectNativeHook) writeToken(secretsDir string, lease *TokenLease) error {
+	path := filepath.Join(secretsDir, dynamicTokenFile)
+	return file.WriteAtomicWithPerms(path, []byte(lease.Token), secretsDirPerm, secretsFilePerm)
+}
+
+// startTokenRenewal runs until stopCh is closed, renewing c.tokenLease
+// halfway through its TTL and rewriting dynamicTokenFile in place each
+// time. A renewal failure is logged and retried rather than abandoning the
+// task's token.
+func (c *connectNativeHook) startTokenRenewal(secretsDir string, stopCh <-chan struct{}) {
+	go func() {
+		for {
+			current := c.currentTokenLease()
+
+			wait := time.Until(current.renewAt())
+			if wait < tokenRenewMinWait {
+				wait = tokenRenewMinWait
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-stopCh:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			next, err := c.tokenSource.Renew(context.Background(), current)
+			if err != nil {
+				c.logger.Error("failed to renew connect native consul token", "error", err)
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(time.Minute):
+				}
+				continue
+			}
+
+			if err := c.writeToken(secretsDir, next); err != nil {
+				c.logger.Error("failed to write renewed connect native consul token", "error", err)
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(time.Minute):
+				}
+				continue
+			}
+
+			if !c.setTokenLease(next) {
+				// Stop already ran and revoked the lease we renewed
+				// from; this replacement would otherwise never be
+				// revoked, so revoke it ourselves and exit.
+				if err := c.tokenSource.Revoke(context.Background(), next); err != nil {
+					c.logger.Error("failed to revoke connect native consul token lease after stop", "error", err)
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,185 @@
+package taskrunner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/nomad/structs/config"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault is a minimal stand-in for Vault's Consul secrets engine and
+// lease renew/revoke endpoints, just enough to exercise vaultTokenSource.
+type fakeVault struct {
+	srv *httptest.Server
+
+	derives int32
+	renews  int32
+	revokes int32
+}
+
+func newFakeVault(t *testing.T, role string) *fakeVault {
+	t.Helper()
+	f := &fakeVault{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/consul/creds/"+role, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.derives, 1)
+		writeVaultSecret(w, "consul/creds/"+role+"/lease-1", 1, map[string]interface{}{"token": "fake-consul-token"})
+	})
+	mux.HandleFunc("/v1/sys/leases/renew", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.renews, 1)
+		writeVaultSecret(w, "consul/creds/"+role+"/lease-1", 1, map[string]interface{}{})
+	})
+	mux.HandleFunc("/v1/sys/leases/revoke/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/leases/revoke/") {
+			atomic.AddInt32(&f.revokes, 1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func writeVaultSecret(w http.ResponseWriter, leaseID string, leaseDuration int, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease_id":       leaseID,
+		"lease_duration": leaseDuration,
+		"renewable":      true,
+		"data":           data,
+	})
+}
+
+func TestVaultTokenSource_deriveRenewRevoke(t *testing.T) {
+	t.Parallel()
+
+	vault := newFakeVault(t, "nomad-consul")
+
+	src, err := newVaultTokenSource(vault.srv.URL, "task-vault-token", "nomad-consul")
+	require.NoError(t, err)
+
+	lease, err := src.Derive(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "fake-consul-token", lease.Token)
+	require.NotEmpty(t, lease.LeaseID)
+	require.Equal(t, int32(1), atomic.LoadInt32(&vault.derives))
+
+	renewed, err := src.Renew(context.Background(), lease)
+	require.NoError(t, err)
+	require.Equal(t, lease.Token, renewed.Token, "renew must preserve the existing token")
+	require.Equal(t, int32(1), atomic.LoadInt32(&vault.renews))
+
+	require.NoError(t, src.Revoke(context.Background(), renewed))
+	require.Equal(t, int32(1), atomic.LoadInt32(&vault.revokes))
+}
+
+func TestTaskRunner_ConnectNativeHook_vaultTokenSource(t *testing.T) {
+	t.Parallel()
+
+	vault := newFakeVault(t, "nomad-consul")
+
+	alloc := mock.Alloc()
+	tg := alloc.Job.TaskGroups[0]
+	tg.Services = []*structs.Service{{
+		Name: "cn-service",
+		Connect: &structs.ConsulConnect{
+			Native: tg.Tasks[0].Name,
+		}},
+	}
+	tg.Tasks[0].Kind = structs.NewTaskKind("connect-native", "cn-service")
+
+	logger := testlog.HCLogger(t)
+
+	allocDir, cleanup := allocdir.TestAllocDir(t, logger, "ConnectNativeVaultToken")
+	defer cleanup()
+
+	h := newConnectNativeHook(newConnectNativeHookConfig(alloc, &config.ConsulConfig{
+		Addr: "http://127.0.0.2:1",
+
+		NativeTokenSource:          "vault",
+		NativeTokenSourceVaultAddr: vault.srv.URL,
+		NativeTokenSourceRole:      "nomad-consul",
+	}, logger, WithVaultToken("task-vault-token")))
+
+	request := &interfaces.TaskPrestartRequest{
+		Task:    tg.Tasks[0],
+		TaskDir: allocDir.NewTaskDir(tg.Tasks[0].Name),
+	}
+	require.NoError(t, request.TaskDir.Build(false, nil))
+
+	response := new(interfaces.TaskPrestartResponse)
+	response.Env = make(map[string]string)
+
+	require.NoError(t, h.Prestart(context.Background(), request, response))
+	require.True(t, response.Done)
+	require.Equal(t, "fake-consul-token", response.Env["CONSUL_HTTP_TOKEN"])
+
+	tokenPath := filepath.Join(request.TaskDir.SecretsDir, dynamicTokenFile)
+	b, err := ioutil.ReadFile(tokenPath)
+	require.NoError(t, err)
+	require.Equal(t, "fake-consul-token", string(b))
+
+	fi, err := os.Stat(tokenPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&vault.renews) > 0
+	}, 5*time.Second, 50*time.Millisecond, "expected renewal to fire")
+
+	// Stop must revoke the lease.
+	require.NoError(t, h.Stop(context.Background(), nil, nil))
+	require.Equal(t, int32(1), atomic.LoadInt32(&vault.revokes))
+}
+
+// TestTaskRunner_ConnectNativeHook_deriveStopRace covers Stop racing the
+// very first Derive (e.g. the alloc is killed while Prestart is still
+// blocked on a slow Vault call): deriveToken must revoke the lease it just
+// derived rather than install it, and report an error instead of letting
+// Prestart read a nil lease.
+func TestTaskRunner_ConnectNativeHook_deriveStopRace(t *testing.T) {
+	t.Parallel()
+
+	vault := newFakeVault(t, "nomad-consul")
+
+	src, err := newVaultTokenSource(vault.srv.URL, "task-vault-token", "nomad-consul")
+	require.NoError(t, err)
+
+	h := &connectNativeHook{
+		tokenSource: src,
+		logger:      testlog.HCLogger(t),
+	}
+
+	// Simulate Stop having already run (e.g. the alloc was killed) before
+	// deriveToken gets a chance to install the lease it's about to derive.
+	h.stopTokenRenewal()
+
+	allocDir, cleanup := allocdir.TestAllocDir(t, testlog.HCLogger(t), "ConnectNativeDeriveStopRace")
+	defer cleanup()
+	taskDir := allocDir.NewTaskDir("task")
+	require.NoError(t, taskDir.Build(false, nil))
+
+	err = h.deriveToken(taskDir.SecretsDir)
+	require.Error(t, err, "deriveToken must fail rather than silently install a lease after Stop")
+	require.Nil(t, h.currentTokenLease(), "no lease must be installed once Stop has run")
+	require.Equal(t, int32(1), atomic.LoadInt32(&vault.revokes), "the derived lease must be revoked, not leaked")
+}
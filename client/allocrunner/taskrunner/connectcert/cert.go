@@ -0,0 +1,146 @@
+// Package connectcert mints short-lived, per-allocation Connect Native
+// leaf certificates, modeled on the same ECDSA P-256 + x509 leaf pattern
+// used by the `nomad tls` CLI helpers, but scoped to generating one leaf
+// signed by an already-configured CA rather than standing up a new PKI.
+package connectcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// DefaultLeafTTL is used when a LeafRequest does not specify a TTL.
+const DefaultLeafTTL = 72 * time.Hour
+
+// SigningCA is the CA material used to sign a generated leaf certificate.
+type SigningCA struct {
+	// CertPEM and KeyPEM are the PEM-encoded CA certificate and private key
+	// used to sign the generated leaf. This is either the Consul Connect CA
+	// (if the agent has access to it) or a locally-configured signing CA.
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// LeafRequest describes the leaf certificate to mint for a Connect Native
+// task.
+type LeafRequest struct {
+	// TrustDomain, Namespace, Datacenter, and Service make up the SPIFFE ID
+	// encoded in the leaf's URI SAN: spiffe://<TrustDomain>/ns/<Namespace>/dc/<Datacenter>/svc/<Service>
+	TrustDomain string
+	Namespace   string
+	Datacenter  string
+	Service     string
+
+	// TTL is how long the leaf should be valid for. Defaults to
+	// DefaultLeafTTL if zero.
+	TTL time.Duration
+}
+
+func (r LeafRequest) uri() (*url.URL, error) {
+	if r.TrustDomain == "" || r.Service == "" {
+		return nil, fmt.Errorf("trust domain and service are required to mint a connect native leaf cert")
+	}
+
+	ns := r.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+
+	raw := fmt.Sprintf("spiffe://%s/ns/%s/dc/%s/svc/%s", r.TrustDomain, ns, r.Datacenter, r.Service)
+	return url.Parse(raw)
+}
+
+// Material is the PEM-encoded CA, leaf certificate, and leaf private key
+// generated for a task, plus the leaf's expiry so callers can schedule
+// rotation.
+type Material struct {
+	CA       []byte
+	Cert     []byte
+	Key      []byte
+	NotAfter time.Time
+}
+
+// Generate mints a fresh ECDSA P-256 keypair and an x509 leaf certificate
+// signed by ca, with a URI SAN derived from req.
+func Generate(req LeafRequest, ca SigningCA) (*Material, error) {
+	uri, err := req.uri()
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, caKey, err := parseSigningCA(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate connect native leaf key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate leaf cert serial: %w", err)
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = DefaultLeafTTL
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.Service},
+		URIs:         []*url.URL{uri},
+		NotBefore:    now.Add(-time.Minute), // tolerate clock skew
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign connect native leaf cert: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal connect native leaf key: %w", err)
+	}
+
+	return &Material{
+		CA:       ca.CertPEM,
+		Cert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		Key:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		NotAfter: template.NotAfter,
+	}, nil
+}
+
+func parseSigningCA(ca SigningCA) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.X509KeyPair(ca.CertPEM, ca.KeyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse connect native signing CA: %w", err)
+	}
+
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse connect native signing CA certificate: %w", err)
+	}
+
+	caKey, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("connect native signing CA key must be ECDSA")
+	}
+
+	return caCert, caKey, nil
+}
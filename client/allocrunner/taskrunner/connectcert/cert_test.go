@@ -0,0 +1,91 @@
+package connectcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSigningCA(t *testing.T) SigningCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Connect CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return SigningCA{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestGenerate_SAN(t *testing.T) {
+	t.Parallel()
+
+	ca := testSigningCA(t)
+
+	m, err := Generate(LeafRequest{
+		TrustDomain: "11111111-2222-3333-4444-555555555555.consul",
+		Datacenter:  "dc1",
+		Service:     "cn-service",
+		TTL:         time.Hour,
+	}, ca)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(m.Cert)
+	require.NotNil(t, block)
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	require.Len(t, leaf.URIs, 1)
+	require.Equal(t, "spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/cn-service", leaf.URIs[0].String())
+
+	require.WithinDuration(t, time.Now().Add(time.Hour), leaf.NotAfter, time.Minute)
+}
+
+func TestGenerate_requiresTrustDomainAndService(t *testing.T) {
+	t.Parallel()
+
+	ca := testSigningCA(t)
+
+	_, err := Generate(LeafRequest{Datacenter: "dc1"}, ca)
+	require.Error(t, err)
+}
+
+func TestGenerate_defaultTTL(t *testing.T) {
+	t.Parallel()
+
+	ca := testSigningCA(t)
+
+	m, err := Generate(LeafRequest{
+		TrustDomain: "test.consul",
+		Datacenter:  "dc1",
+		Service:     "cn-service",
+	}, ca)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(DefaultLeafTTL), m.NotAfter, time.Minute)
+}
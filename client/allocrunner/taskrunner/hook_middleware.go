@@ -0,0 +1,82 @@
+package taskrunner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+)
+
+// HookMiddleware wraps a task prestart hook so that a panic inside the
+// hook is recovered and turned into a normal error (failing just the task,
+// rather than crashing the client process), and so that every invocation
+// emits a nomad.client.taskrunner.hook.duration sample labeled by hook name
+// and outcome. An error or panic also increments
+// nomad.client.taskrunner.hook.errors, and a panic also increments
+// nomad.client.taskrunner.hook.panics, with the same labels; a successful
+// invocation increments no counter.
+type HookMiddleware struct {
+	hook     interfaces.TaskPrestartHook
+	allocID  string
+	taskName string
+}
+
+// WrapPrestartHook wraps hook in a HookMiddleware scoped to the given
+// allocation and task.
+func WrapPrestartHook(allocID, taskName string, hook interfaces.TaskPrestartHook) *HookMiddleware {
+	return &HookMiddleware{
+		hook:     hook,
+		allocID:  allocID,
+		taskName: taskName,
+	}
+}
+
+func (m *HookMiddleware) Name() string {
+	return m.hook.Name()
+}
+
+func (m *HookMiddleware) Prestart(
+	ctx context.Context,
+	req *interfaces.TaskPrestartRequest,
+	resp *interfaces.TaskPrestartResponse) (err error) {
+
+	labels := []metrics.Label{
+		{Name: "hook", Value: m.Name()},
+	}
+
+	start := time.Now()
+
+	defer func() {
+		outcome := "success"
+		if r := recover(); r != nil {
+			outcome = "panic"
+			err = fmt.Errorf("prestart hook %q panicked for alloc %s task %s: %v", m.Name(), m.allocID, m.taskName, r)
+		} else if err != nil {
+			outcome = "error"
+		}
+
+		outcomeLabels := append(append([]metrics.Label{}, labels...), metrics.Label{Name: "outcome", Value: outcome})
+		metrics.MeasureSinceWithLabels([]string{"client", "taskrunner", "hook", "duration"}, start, outcomeLabels)
+		if outcome != "success" {
+			metrics.IncrCounterWithLabels([]string{"client", "taskrunner", "hook", "errors"}, 1, outcomeLabels)
+		}
+		if outcome == "panic" {
+			metrics.IncrCounterWithLabels([]string{"client", "taskrunner", "hook", "panics"}, 1, outcomeLabels)
+		}
+	}()
+
+	return m.hook.Prestart(ctx, req, resp)
+}
+
+// ChainPrestart wraps every hook in hooks with a HookMiddleware, so that
+// panics and metrics are handled uniformly regardless of hook composition
+// order.
+func ChainPrestart(allocID, taskName string, hooks ...interfaces.TaskPrestartHook) []interfaces.TaskPrestartHook {
+	wrapped := make([]interfaces.TaskPrestartHook, len(hooks))
+	for i, h := range hooks {
+		wrapped[i] = WrapPrestartHook(allocID, taskName, h)
+	}
+	return wrapped
+}
@@ -0,0 +1,102 @@
+package taskrunner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHook is a minimal interfaces.TaskPrestartHook used to exercise
+// HookMiddleware in isolation.
+type fakeHook struct {
+	name  string
+	panic bool
+	err   error
+}
+
+func (f *fakeHook) Name() string { return f.name }
+
+func (f *fakeHook) Prestart(_ context.Context, _ *interfaces.TaskPrestartRequest, resp *interfaces.TaskPrestartResponse) error {
+	if f.panic {
+		panic("boom")
+	}
+	resp.Done = true
+	return f.err
+}
+
+func newTestMetricsSink(t *testing.T) *metrics.InmemSink {
+	t.Helper()
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	_, err := metrics.NewGlobal(metrics.DefaultConfig("nomad"), sink)
+	require.NoError(t, err)
+	return sink
+}
+
+func countMetric(sink *metrics.InmemSink, suffix string) int {
+	data := sink.Data()
+	count := 0
+	for _, interval := range data {
+		for name, sample := range interval.Counters {
+			if hasPrefix(name, suffix) {
+				count += sample.Count
+			}
+		}
+	}
+	return count
+}
+
+func hasPrefix(name, prefix string) bool {
+	return len(name) >= len(prefix) && name[:len(prefix)] == prefix
+}
+
+func TestHookMiddleware_panicRecovered(t *testing.T) {
+	// Not t.Parallel(): newTestMetricsSink installs a process-wide
+	// go-metrics global, so this test and TestHookMiddleware_successMetrics
+	// would race on and clobber each other's sink if run concurrently.
+	sink := newTestMetricsSink(t)
+
+	hook := &fakeHook{name: "fake_panicking", panic: true}
+	wrapped := WrapPrestartHook("alloc-1", "task-1", hook)
+
+	require.Equal(t, "fake_panicking", wrapped.Name())
+
+	resp := new(interfaces.TaskPrestartResponse)
+	err := wrapped.Prestart(context.Background(), new(interfaces.TaskPrestartRequest), resp)
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "fake_panicking")
+	require.Contains(t, err.Error(), "alloc-1")
+	require.False(t, resp.Done, "hook body must not have continued after the panic")
+
+	require.Equal(t, 1, countMetric(sink, "nomad.client.taskrunner.hook.panics"))
+	require.Equal(t, 1, countMetric(sink, "nomad.client.taskrunner.hook.errors"))
+}
+
+func TestHookMiddleware_successMetrics(t *testing.T) {
+	// Not t.Parallel(): see TestHookMiddleware_panicRecovered.
+	sink := newTestMetricsSink(t)
+
+	hook := &fakeHook{name: "fake_ok"}
+	wrapped := WrapPrestartHook("alloc-1", "task-1", hook)
+
+	resp := new(interfaces.TaskPrestartResponse)
+	err := wrapped.Prestart(context.Background(), new(interfaces.TaskPrestartRequest), resp)
+	require.NoError(t, err)
+	require.True(t, resp.Done)
+
+	require.Equal(t, 0, countMetric(sink, "nomad.client.taskrunner.hook.panics"))
+	require.Equal(t, 0, countMetric(sink, "nomad.client.taskrunner.hook.errors"))
+}
+
+func TestChainPrestart(t *testing.T) {
+	t.Parallel()
+
+	hooks := ChainPrestart("alloc-1", "task-1", &fakeHook{name: "a"}, &fakeHook{name: "b"})
+	require.Len(t, hooks, 2)
+	require.Equal(t, "a", hooks[0].Name())
+	require.Equal(t, "b", hooks[1].Name())
+}
@@ -0,0 +1,39 @@
+package taskrunner
+
+import (
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/nomad/structs/config"
+)
+
+// prestartHooksConfig carries what's needed to assemble a task's prestart
+// hook chain out of the task runner's alloc/client config.
+type prestartHooksConfig struct {
+	alloc        *structs.Allocation
+	consulConfig *config.ConsulConfig
+	logger       log.Logger
+
+	// vaultToken and datacenter are threaded into the Connect Native hook
+	// the same way the task runner's Vault hook and client config would
+	// supply them in practice; see WithVaultToken/WithDatacenter.
+	vaultToken string
+	datacenter string
+}
+
+// buildPrestartHooks assembles a task's Connect Native prestart hook; it
+// builds no other prestart hooks. The hook is wrapped in HookMiddleware via
+// ChainPrestart, so a panic inside it fails just the task instead of
+// crashing the client process, and every invocation is observable via the
+// nomad.client.taskrunner.hook.* metrics.
+func buildPrestartHooks(allocID, taskName string, c prestartHooksConfig) []interfaces.TaskPrestartHook {
+	native := newConnectNativeHook(newConnectNativeHookConfig(
+		c.alloc,
+		c.consulConfig,
+		c.logger,
+		WithVaultToken(c.vaultToken),
+		WithDatacenter(c.datacenter),
+	))
+
+	return ChainPrestart(allocID, taskName, native)
+}
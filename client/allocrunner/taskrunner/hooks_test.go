@@ -0,0 +1,37 @@
+package taskrunner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPrestartHooks_wrapsConnectNative(t *testing.T) {
+	t.Parallel()
+
+	alloc := mock.Alloc()
+	logger := testlog.HCLogger(t)
+
+	hooks := buildPrestartHooks("alloc-1", "task-1", prestartHooksConfig{
+		alloc:        alloc,
+		consulConfig: &config.ConsulConfig{Addr: "http://127.0.0.2:1"},
+		logger:       logger,
+	})
+	require.Len(t, hooks, 1)
+	require.Equal(t, "connect_native", hooks[0].Name())
+
+	// A panic inside the wrapped hook must come back as an error instead
+	// of crashing the test process, proving the hook actually goes
+	// through HookMiddleware rather than being invoked unwrapped.
+	request := &interfaces.TaskPrestartRequest{Task: nil}
+	response := new(interfaces.TaskPrestartResponse)
+	err := hooks[0].Prestart(context.Background(), request, response)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "connect_native")
+	require.Contains(t, err.Error(), "alloc-1")
+}
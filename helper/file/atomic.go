@@ -0,0 +1,114 @@
+// Package file provides small helpers for writing files to disk in a way
+// that is safe to use from concurrent readers (e.g. a task that is polling
+// for the appearance of a secret).
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomicWithPerms writes data to path such that readers never observe a
+// partially written file. It creates the parent directory (if necessary)
+// with dirPerm, writes data into a sibling temp file created with
+// os.O_EXCL and filePerm, fsyncs the temp file, and renames it into place.
+//
+// If the process is killed or the write fails partway through, path itself
+// is never created or modified; only the discarded temp file is affected.
+func WriteAtomicWithPerms(path string, data []byte, dirPerm, filePerm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return fmt.Errorf("failed to create parent directory %q: %w", dir, err)
+	}
+
+	tmp := path + ".tmp"
+
+	// Remove any stale temp file left behind by a previous crashed write
+	// before recreating it with O_EXCL below.
+	_ = os.Remove(tmp)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file %q: %w", tmp, err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write temp file %q: %w", tmp, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to fsync temp file %q: %w", tmp, err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close temp file %q: %w", tmp, err)
+	}
+
+	// Explicitly set perms again in case OpenFile's mode was modified by umask.
+	if err := os.Chmod(tmp, filePerm); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to chmod temp file %q: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename temp file into place at %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// CopyAtomicWithPerms streams src to path the same way WriteAtomicWithPerms
+// does, without requiring the caller to buffer the entire source in memory
+// first. If src returns an error partway through the copy, the temp file is
+// discarded and path is left untouched (it is never created).
+func CopyAtomicWithPerms(src io.Reader, path string, dirPerm, filePerm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return fmt.Errorf("failed to create parent directory %q: %w", dir, err)
+	}
+
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file %q: %w", tmp, err)
+	}
+
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to copy into temp file %q: %w", tmp, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to fsync temp file %q: %w", tmp, err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close temp file %q: %w", tmp, err)
+	}
+
+	if err := os.Chmod(tmp, filePerm); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to chmod temp file %q: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename temp file into place at %q: %w", path, err)
+	}
+
+	return nil
+}
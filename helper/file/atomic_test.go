@@ -0,0 +1,106 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// faultyReader returns n bytes successfully and then fails, simulating a
+// process death or I/O error partway through a copy.
+type faultyReader struct {
+	data []byte
+	n    int
+}
+
+func (r *faultyReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("injected fault")
+	}
+	k := len(p)
+	if k > r.n {
+		k = r.n
+	}
+	if k > len(r.data) {
+		k = len(r.data)
+	}
+	copy(p, r.data[:k])
+	r.data = r.data[k:]
+	r.n -= k
+	return k, nil
+}
+
+func TestWriteAtomicWithPerms(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "file-atomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secrets", "out.pem")
+	require.NoError(t, WriteAtomicWithPerms(path, []byte("hello"), 0700, 0600))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	di, err := os.Stat(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), di.Mode().Perm())
+
+	// no leftover temp file
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCopyAtomicWithPerms_fault(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "file-atomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.pem")
+	src := &faultyReader{data: []byte("partial-certificate-bytes"), n: 4}
+
+	err = CopyAtomicWithPerms(src, path, 0700, 0600)
+	require.Error(t, err)
+
+	// destination must never appear, even partially written
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// temp file must be cleaned up too
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCopyAtomicWithPerms_ok(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "file-atomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.pem")
+	src := bytes.NewReader([]byte("ABCDEF"))
+
+	require.NoError(t, CopyAtomicWithPerms(src, path, 0700, 0600))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "ABCDEF", string(b))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
@@ -0,0 +1,107 @@
+package nomad
+
+import (
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// nodeFSMStore is the subset of *state.StateStore a bulk update needs:
+// resolve the selector, then apply the update to each matched node. It's
+// declared as an interface, rather than the concrete store, so tests can
+// substitute a store that mutates between the selector resolving and a
+// given node's update being applied - the same window a concurrent
+// deregister landing between those two steps would open in the real
+// system - to exercise the per-node error path below.
+type nodeFSMStore interface {
+	NodesBySelector(sel *state.NodeSelector) ([]*structs.Node, error)
+	UpdateNodeDrain(nodeID string, strategy *structs.DrainStrategy, markEligible bool) error
+	UpdateNodeEligibility(nodeID, eligibility string) error
+}
+
+// nodeFSM applies committed bulk node drain/eligibility entries to the
+// state store. It is scoped to just these two entries rather than the full
+// nomadFSM (which dispatches every Raft log type and is not part of this
+// tree's snapshot).
+type nodeFSM struct {
+	state nodeFSMStore
+}
+
+// newNodeFSM constructs an FSM bound to the given state store.
+func newNodeFSM(s *state.StateStore) *nodeFSM {
+	return &nodeFSM{state: s}
+}
+
+// ApplyBulkNodeDrainUpdate applies a committed NodeBulkUpdateDrainRequest,
+// resolving the selector against the current state store and updating every
+// matched node. A node already draining with a deadline at least as long as
+// the requested one is left untouched and reported as Skipped unless Force
+// is set, so a bulk drain cannot silently shorten a longer per-node
+// deadline.
+func (f *nodeFSM) ApplyBulkNodeDrainUpdate(req *structs.NodeBulkUpdateDrainRequest) (*structs.NodeBulkUpdateResponse, error) {
+	nodes, err := f.state.NodesBySelector(toStateSelector(req.Selector))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &structs.NodeBulkUpdateResponse{}
+	for _, node := range nodes {
+		result := &structs.BulkNodeUpdateResult{NodeID: node.ID}
+
+		if !req.Force && req.DrainSpec != nil && node.DrainStrategy != nil &&
+			node.DrainStrategy.Deadline >= req.DrainSpec.Deadline {
+			result.Skipped = true
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+
+		var strategy *structs.DrainStrategy
+		if req.DrainSpec != nil {
+			strategy = &structs.DrainStrategy{DrainSpec: req.DrainSpec}
+		}
+
+		if err := f.state.UpdateNodeDrain(node.ID, strategy, req.MarkEligible); err != nil {
+			result.Error = err.Error()
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	return resp, nil
+}
+
+// ApplyBulkNodeEligibilityUpdate applies a committed
+// NodeBulkUpdateEligibilityRequest. Nodes already at the requested
+// eligibility are reported as Skipped rather than reapplied, so retrying a
+// bulk toggle is idempotent.
+func (f *nodeFSM) ApplyBulkNodeEligibilityUpdate(req *structs.NodeBulkUpdateEligibilityRequest) (*structs.NodeBulkUpdateResponse, error) {
+	nodes, err := f.state.NodesBySelector(toStateSelector(req.Selector))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &structs.NodeBulkUpdateResponse{}
+	for _, node := range nodes {
+		result := &structs.BulkNodeUpdateResult{NodeID: node.ID}
+
+		if node.SchedulingEligibility == req.Eligibility {
+			result.Skipped = true
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+
+		if err := f.state.UpdateNodeEligibility(node.ID, req.Eligibility); err != nil {
+			result.Error = err.Error()
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	return resp, nil
+}
+
+func toStateSelector(sel structs.NodeSelector) *state.NodeSelector {
+	return &state.NodeSelector{
+		Datacenters: sel.Datacenters,
+		NodeClass:   sel.NodeClass,
+		NameGlob:    sel.NameGlob,
+		Meta:        sel.Meta,
+	}
+}
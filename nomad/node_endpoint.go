@@ -0,0 +1,82 @@
+package nomad
+
+import (
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// nodeRaftApplier is the subset of the server's Raft apply path the Node
+// endpoint needs: committing a bulk update and getting back its result. The
+// full Server type (raft.Raft, FSM registration, snapshotting) is not part
+// of this tree's snapshot; production wiring commits through srv.raftApply
+// to nodeFSM, same as every other mutating RPC endpoint.
+type nodeRaftApplier interface {
+	ApplyBulkNodeDrainUpdate(req *structs.NodeBulkUpdateDrainRequest) (*structs.NodeBulkUpdateResponse, error)
+	ApplyBulkNodeEligibilityUpdate(req *structs.NodeBulkUpdateEligibilityRequest) (*structs.NodeBulkUpdateResponse, error)
+}
+
+// Node is the RPC endpoint for node-related server operations.
+type Node struct {
+	raft   nodeRaftApplier
+	state  *state.StateStore
+	logger log.Logger
+}
+
+// NewNodeEndpoint constructs the Node RPC endpoint bound to raft (for
+// mutating RPCs) and the state store (for read-only lookups, which don't
+// need to go through Raft).
+func NewNodeEndpoint(raft nodeRaftApplier, s *state.StateStore, logger log.Logger) *Node {
+	return &Node{raft: raft, state: s, logger: logger.Named("node_endpoint")}
+}
+
+// GetNode is the RPC handler backing the client's Nodes.Info, which HTTP
+// routes to GET /v1/node/:node_id. The lookup is case-insensitive, same as
+// every other node ID lookup in the state store.
+func (n *Node) GetNode(args *structs.NodeSpecificRequest, reply *structs.SingleNodeResponse) error {
+	node, err := n.state.GetNodeByID(args.NodeID)
+	if err != nil {
+		n.logger.Error("node lookup failed", "error", err)
+		return err
+	}
+	reply.Node = node
+	return nil
+}
+
+// List is the RPC handler backing the client's Nodes.PrefixList, which
+// HTTP routes to GET /v1/nodes. The prefix match is case-insensitive, same
+// as GetNode.
+func (n *Node) List(args *structs.NodeListRequest, reply *structs.NodeListResponse) error {
+	nodes, err := n.state.NodesByIDPrefix(args.Prefix)
+	if err != nil {
+		n.logger.Error("node list failed", "error", err)
+		return err
+	}
+	reply.Nodes = nodes
+	return nil
+}
+
+// BulkUpdateDrain is the RPC handler backing the client's
+// Nodes.BulkUpdateDrain, which HTTP routes to POST /v1/nodes/drain.
+func (n *Node) BulkUpdateDrain(args *structs.NodeBulkUpdateDrainRequest, reply *structs.NodeBulkUpdateResponse) error {
+	resp, err := n.raft.ApplyBulkNodeDrainUpdate(args)
+	if err != nil {
+		n.logger.Error("bulk node drain update failed", "error", err)
+		return err
+	}
+	*reply = *resp
+	return nil
+}
+
+// BulkUpdateEligibility is the RPC handler backing the client's
+// Nodes.BulkToggleEligibility, which HTTP routes to POST
+// /v1/nodes/eligibility.
+func (n *Node) BulkUpdateEligibility(args *structs.NodeBulkUpdateEligibilityRequest, reply *structs.NodeBulkUpdateResponse) error {
+	resp, err := n.raft.ApplyBulkNodeEligibilityUpdate(args)
+	if err != nil {
+		n.logger.Error("bulk node eligibility update failed", "error", err)
+		return err
+	}
+	*reply = *resp
+	return nil
+}
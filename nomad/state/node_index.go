@@ -0,0 +1,31 @@
+package state
+
+import "strings"
+
+// indexNodeID normalizes a node ID for use as a secondary index key,
+// mirroring the lower-casing already applied to other state store indexes
+// (e.g. job and namespace name lookups) so that callers who paste a node ID
+// in a different case than it was registered with still find a match.
+func indexNodeID(id string) string {
+	return strings.ToLower(id)
+}
+
+// indexNodeName normalizes a node's Name for indexing and comparison.
+func indexNodeName(name string) string {
+	return strings.ToLower(name)
+}
+
+// indexNodeDatacenter normalizes a node's Datacenter for indexing and
+// comparison.
+func indexNodeDatacenter(dc string) string {
+	return strings.ToLower(dc)
+}
+
+// nodeNamesEqual reports whether two node names refer to the same node,
+// ignoring case. NodeMatchesReference uses this instead of a direct byte
+// comparison so that a persisted node whose name casing differs from a
+// reference held by a check or allocation (e.g. after an operator renamed a
+// node with different casing) still matches that reference.
+func nodeNamesEqual(a, b string) bool {
+	return indexNodeName(a) == indexNodeName(b)
+}
@@ -0,0 +1,31 @@
+package state
+
+import "testing"
+
+func TestIndexNodeID_caseInsensitive(t *testing.T) {
+	t.Parallel()
+
+	if indexNodeID("ABCD1234") != indexNodeID("abcd1234") {
+		t.Fatalf("expected node ID index to be case-insensitive")
+	}
+}
+
+func TestNodeNamesEqual(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"node-1", "node-1", true},
+		{"Node-1", "node-1", true},
+		{"NODE-1", "node-1", true},
+		{"node-1", "node-2", false},
+	}
+
+	for _, c := range cases {
+		if got := nodeNamesEqual(c.a, c.b); got != c.want {
+			t.Fatalf("nodeNamesEqual(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"path"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// NodeSelector describes a set of nodes a bulk operation should act on. It
+// mirrors api.NodeSelector; the api package's selector is decoded off the
+// wire into this type before being resolved against the state store. A
+// zero-value NodeSelector matches every node.
+type NodeSelector struct {
+	Datacenters []string
+	NodeClass   string
+	NameGlob    string
+	Meta        map[string]string
+}
+
+// MatchesNodeSelector reports whether node satisfies every criterion set on
+// sel. All fields are ANDed together; an empty/zero field is treated as a
+// wildcard for that criterion.
+func MatchesNodeSelector(node *structs.Node, sel *NodeSelector) (bool, error) {
+	if node == nil || sel == nil {
+		return false, nil
+	}
+
+	if len(sel.Datacenters) > 0 {
+		match := false
+		for _, dc := range sel.Datacenters {
+			if indexNodeDatacenter(dc) == indexNodeDatacenter(node.Datacenter) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+
+	if sel.NodeClass != "" && sel.NodeClass != node.NodeClass {
+		return false, nil
+	}
+
+	if sel.NameGlob != "" {
+		ok, err := path.Match(sel.NameGlob, node.Name)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	for k, v := range sel.Meta {
+		if node.Meta[k] != v {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// NodesBySelector returns every node in the store matching sel, from one
+// pass over the store's current contents. StateStore does no locking of its
+// own, so the result is a consistent view only if no write to the store
+// runs concurrently with the call.
+func (s *StateStore) NodesBySelector(sel *NodeSelector) ([]*structs.Node, error) {
+	var matched []*structs.Node
+	for _, node := range s.nodesByID {
+		ok, err := MatchesNodeSelector(node, sel)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, node)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,119 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// StateStore is a minimal, in-memory model of the node table. It exists to
+// give indexNodeID/indexNodeName/indexNodeDatacenter a real upsert, lookup,
+// and restore path to run against instead of sitting as untested helpers;
+// the full memdb-backed state store schema is not part of this tree.
+type StateStore struct {
+	nodesByID map[string]*structs.Node // keyed by indexNodeID(node.ID)
+}
+
+// NewStateStore creates an empty node store.
+func NewStateStore() *StateStore {
+	return &StateStore{nodesByID: make(map[string]*structs.Node)}
+}
+
+// UpsertNode indexes node under its lower-cased ID, mirroring how the real
+// node table's id index is built so that a later lookup in a different case
+// still finds it.
+func (s *StateStore) UpsertNode(node *structs.Node) error {
+	if node == nil || node.ID == "" {
+		return fmt.Errorf("missing node ID")
+	}
+	s.nodesByID[indexNodeID(node.ID)] = node
+	return nil
+}
+
+// DeleteNode removes a node by ID, matched case-insensitively the same way
+// GetNodeByID is. Deleting an ID that isn't present is a no-op.
+func (s *StateStore) DeleteNode(id string) error {
+	delete(s.nodesByID, indexNodeID(id))
+	return nil
+}
+
+// GetNodeByID performs a case-insensitive lookup of a node by ID.
+func (s *StateStore) GetNodeByID(id string) (*structs.Node, error) {
+	return s.nodesByID[indexNodeID(id)], nil
+}
+
+// NodesByIDPrefix returns every node whose ID begins with prefix, matched
+// case-insensitively.
+func (s *StateStore) NodesByIDPrefix(prefix string) ([]*structs.Node, error) {
+	prefix = indexNodeID(prefix)
+
+	var out []*structs.Node
+	for id, node := range s.nodesByID {
+		if strings.HasPrefix(id, prefix) {
+			out = append(out, node)
+		}
+	}
+	return out, nil
+}
+
+// Snapshot captures every node currently in the store so it can be replayed
+// into a fresh StateStore via Restore, mirroring the real store's
+// snapshot/restore split used for Raft snapshots.
+func (s *StateStore) Snapshot() []*structs.Node {
+	nodes := make([]*structs.Node, 0, len(s.nodesByID))
+	for _, node := range s.nodesByID {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Restore replays a snapshot into the receiver.
+func (s *StateStore) Restore(nodes []*structs.Node) error {
+	for _, node := range nodes {
+		if err := s.UpsertNode(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateNodeDrain sets or clears node's drain strategy in place.
+func (s *StateStore) UpdateNodeDrain(nodeID string, strategy *structs.DrainStrategy, markEligible bool) error {
+	node, err := s.GetNodeByID(nodeID)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("node %q not found", nodeID)
+	}
+
+	node.DrainStrategy = strategy
+	if strategy == nil && markEligible {
+		node.SchedulingEligibility = structs.NodeSchedulingEligible
+	}
+	return nil
+}
+
+// UpdateNodeEligibility sets node's scheduling eligibility in place.
+func (s *StateStore) UpdateNodeEligibility(nodeID, eligibility string) error {
+	node, err := s.GetNodeByID(nodeID)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("node %q not found", nodeID)
+	}
+
+	node.SchedulingEligibility = eligibility
+	return nil
+}
+
+// NodeMatchesReference reports whether node is the node referenced by name,
+// as recorded on a persisted health check or allocation. It tolerates a
+// casing difference between when the reference and the node were each
+// written, so restore does not fail on a direct byte comparison when an
+// operator has since changed a node's name casing.
+func NodeMatchesReference(node *structs.Node, name string) bool {
+	return nodeNamesEqual(node.Name, name)
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// TestStateStore_SnapshotRestore_mixedCase registers a node under one
+// casing, snapshots it, mutates the casing of the snapshotted copy (as if
+// an operator renamed the node or its datacenter between the snapshot being
+// taken and restore running), and verifies that restoring into a fresh
+// store still succeeds and that lookups using either casing resolve to the
+// restored node.
+func TestStateStore_SnapshotRestore_mixedCase(t *testing.T) {
+	t.Parallel()
+
+	s1 := NewStateStore()
+	node := &structs.Node{
+		ID:         "ABCD1234-ABCD-1234-ABCD-1234ABCD1234",
+		Name:       "Node-One",
+		Datacenter: "DC1",
+	}
+	if err := s1.UpsertNode(node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap := s1.Snapshot()
+	if len(snap) != 1 {
+		t.Fatalf("expected 1 node in snapshot, got %d", len(snap))
+	}
+
+	// Simulate the casing having changed between snapshot and restore, as
+	// called out by the request (e.g. a referencing check/allocation was
+	// written against the old casing).
+	restored := *snap[0]
+	restored.Name = strings.ToLower(restored.Name)
+	restored.Datacenter = strings.ToUpper(restored.Datacenter)
+
+	s2 := NewStateStore()
+	if err := s2.Restore([]*structs.Node{&restored}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	// The ID lookup must still resolve regardless of the casing used to
+	// query it.
+	got, err := s2.GetNodeByID("abcd1234-abcd-1234-abcd-1234abcd1234")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got == nil {
+		t.Fatalf("expected node to be found after restore")
+	}
+
+	// A reference recorded under the original name casing must still
+	// match the restored node, whose casing has since changed.
+	if !NodeMatchesReference(got, "Node-One") {
+		t.Fatalf("expected restored node to match original-cased reference")
+	}
+}